@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
 	"log"
@@ -12,53 +11,168 @@ import (
 	"golang.org/x/crypto/ssh/agent"
 )
 
-// Given an agent, CA private key, username and some settings, generate
-// an SSH certificate and insert it in the agent.
-func addCertToAgent(agentC agent.ExtendedAgent, caKey ssh.Signer, user *util.UserPrincipals, settings util.Settings) error {
+// certIssuer holds the certificate authority key used to sign
+// certificates, the allocator for their serial numbers, the ledger in
+// which they are recorded and the requests waiting for approval
+type certIssuer struct {
+	caKey     ssh.Signer
+	serials   *util.SerialAllocator
+	ledger    *util.Ledger
+	approvals *approvals
+}
+
+// certRequest describes a request for a certificate: the user and the
+// key they authenticated with, the certificate specification, the
+// settings in use, the client connection, and the reason given for the
+// certificate and its approver, if these are required
+type certRequest struct {
+	user     *util.UserPrincipals
+	key      *util.UserKey
+	spec     *util.CertSpec
+	settings *util.Settings
+	conn     ssh.ConnMetadata
+	reason   string
+	approver string
+}
+
+// Given an agent, certificate issuer and request, generate a new key of
+// the requested type and an SSH certificate for it, record the
+// certificate in the ledger and insert the key and certificate in the
+// agent.
+func addCertToAgent(agentC agent.ExtendedAgent, issuer *certIssuer, req *certRequest) (*ssh.Certificate, error) {
 
 	// generate new keys for signing the certificate
-	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	privKey, sshPubKey, err := util.GenerateKey(req.spec.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := issuer.sign(req, sshPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = agentC.Add(agent.AddedKey{
+		PrivateKey:   privKey,
+		Certificate:  cert,
+		LifetimeSecs: uint32(cert.ValidBefore - cert.ValidAfter),
+		Comment:      fmt.Sprintf("%s_serial:%d", cert.KeyId, cert.Serial),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cert signing error: %s", err)
+	}
+	return cert, nil
+}
+
+// signUserKey makes an SSH certificate for the public key the user
+// authenticated with, so that a certificate for a hardware key keeps
+// the hardware presence requirement, and records it in the ledger. The
+// agent protocol requires a private key to add a certificate to an
+// agent, so the certificate is returned for the user to save.
+func signUserKey(issuer *certIssuer, req *certRequest) (*ssh.Certificate, error) {
+	return issuer.sign(req, req.key.PublicKey)
+}
+
+// certValidity returns the validity period of a certificate issued at
+// now for the request. Certificates are only issued while the user's
+// account is valid and within the access windows, and expire no later
+// than the account and the windows.
+func certValidity(req *certRequest, now time.Time) (from, to time.Time, err error) {
+	from = now.UTC()
+	if err := req.user.ActiveAt(from); err != nil {
+		return from, to, err
+	}
+	to = req.user.CapValidBefore(from.Add(time.Duration(req.spec.Validity) * time.Minute)).UTC()
+
+	windowEnd, err := req.settings.AccessUntil(req.spec, from)
 	if err != nil {
-		return fmt.Errorf("could not generate ed25519 keys %s", err)
+		return from, to, err
+	}
+	if !windowEnd.IsZero() && to.After(windowEnd) {
+		to = windowEnd.UTC()
 	}
+	return from, to, nil
+}
 
-	sshPubKey, err := ssh.NewPublicKey(pubKey)
+// sign makes an SSH certificate for pubKey following the request, and
+// records it in the ledger
+func (issuer *certIssuer) sign(req *certRequest, pubKey ssh.PublicKey) (*ssh.Certificate, error) {
+
+	user, key, spec, settings := req.user, req.key, req.spec, req.settings
+
+	if spec.RequireReason && req.reason == "" {
+		return nil, fmt.Errorf("profile %s requires a reason", spec.Profile)
+	}
+	if spec.RequireApproval && req.approver == "" {
+		return nil, fmt.Errorf("principals %s require approval", spec.Principals)
+	}
+
+	// bind the certificate to the client's network if configured
+	err := spec.BindSource(req.conn.RemoteAddr())
 	if err != nil {
-		return fmt.Errorf("could not convert ed25519 public key to ssh key %s", err)
+		return nil, err
 	}
 
-	fromT := time.Now().UTC()
-	toT := time.Now().UTC().Add(time.Duration(settings.Validity) * time.Minute)
-	fmtF := "2006-01-02T15:04"
-	fmtT := "2006-01-02T15:04MST"
-	timeStamp := fmt.Sprintf("from:%s_to:%s", fromT.Format(fmtF), toT.Format(fmtT))
-	identifier := fmt.Sprintf("%s_%s_%s", settings.Organisation, user.Name, timeStamp)
+	fromT, toT, err := certValidity(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	extensions, err := settings.RenderExtensions(spec, util.TemplateData{Name: user.Name, Profile: spec.Profile})
+	if err != nil {
+		return nil, err
+	}
 	permissions := ssh.Permissions{}
-	permissions.Extensions = settings.Extensions
+	permissions.Extensions = extensions
+	permissions.CriticalOptions = spec.CriticalOptions
+
+	serial, err := issuer.serials.Next()
+	if err != nil {
+		return nil, fmt.Errorf("could not allocate serial %s", err)
+	}
+
+	identifier, err := settings.KeyID(settings.NewKeyIDData(
+		util.TemplateData{Name: user.Name, Profile: spec.Profile}, key.Label, serial, fromT, toT, req.reason))
+	if err != nil {
+		return nil, err
+	}
 
 	cert := &ssh.Certificate{
+		Serial:          serial,
 		CertType:        ssh.UserCert,
-		Key:             sshPubKey,
+		Key:             pubKey,
 		KeyId:           identifier,
 		ValidAfter:      uint64(fromT.Unix()),
 		ValidBefore:     uint64(toT.Unix()),
-		ValidPrincipals: user.Principals,
+		ValidPrincipals: spec.Principals,
 		Permissions:     permissions,
 	}
-	if err := cert.SignCert(rand.Reader, caKey); err != nil {
-		return fmt.Errorf("cert signing error: %s", err)
+	if err := cert.SignCert(rand.Reader, issuer.caKey); err != nil {
+		return nil, fmt.Errorf("cert signing error: %s", err)
 	}
 
-	err = agentC.Add(agent.AddedKey{
-		PrivateKey:   privKey,
-		Certificate:  cert,
-		LifetimeSecs: settings.Validity * 60, // minutes to seconds
-		Comment:      identifier,
+	// certificates are only issued once recorded
+	err = issuer.ledger.Record(util.LedgerEntry{
+		Serial:          serial,
+		KeyID:           identifier,
+		Issued:          fromT,
+		User:            user.Name,
+		Fingerprint:     key.Fingerprint,
+		KeyLabel:        key.Label,
+		Profile:         spec.Profile,
+		Reason:          req.reason,
+		ApprovedBy:      req.approver,
+		Principals:      cert.ValidPrincipals,
+		ValidAfter:      fromT,
+		ValidBefore:     toT,
+		Extensions:      cert.Extensions,
+		CriticalOptions: cert.CriticalOptions,
+		RemoteAddr:      req.conn.RemoteAddr().String(),
+		ClientVersion:   string(req.conn.ClientVersion()),
 	})
 	if err != nil {
-		return fmt.Errorf("cert signing error: %s", err)
+		return nil, fmt.Errorf("could not record certificate in ledger: %s", err)
 	}
 
-	log.Printf("completed making certificate for %s (fp %s) principals %s expiring %s", user.Name, user.Fingerprint, user.Principals, toT.Format(fmtT))
-	return nil
+	log.Printf("completed making certificate serial %d for %s (key %s) principals %s expiring %s", serial, user.Name, key, spec.Principals, toT.Format(util.KeyIDToFormat))
+	return cert, nil
 }
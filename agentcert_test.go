@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/rorycl/sshagentca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testConnMetadata is the client connection metadata used in signing
+type testConnMetadata struct {
+	ssh.ConnMetadata
+}
+
+func (testConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+func (testConnMetadata) ClientVersion() []byte { return []byte("SSH-2.0-test") }
+
+// newTestIssuer makes a certificate issuer with a temporary serial file
+// and ledger
+func newTestIssuer(t *testing.T) *certIssuer {
+	t.Helper()
+	serials, err := util.NewSerialAllocator(filepath.Join(t.TempDir(), "serial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := util.OpenLedger(filepath.Join(t.TempDir(), "ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	return &certIssuer{caKey: newTestSigner(t), serials: serials, ledger: ledger, approvals: newApprovals()}
+}
+
+// a FIDO sk-ssh-ed25519 public key, which has no private key available
+// to the server, can be certified
+func TestSignUserKeySecurityKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skKey, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{"sk-ssh-ed25519@openssh.com", pub, "ssh:"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := newTestIssuer(t)
+	req := &certRequest{
+		user:     &util.UserPrincipals{Name: "tester", SignUserKey: true},
+		key:      &util.UserKey{PublicKey: skKey, Fingerprint: ssh.FingerprintSHA256(skKey)},
+		spec:     &util.CertSpec{Principals: []string{"web"}, Validity: 30},
+		settings: &util.Settings{Organisation: "testorg"},
+		conn:     testConnMetadata{},
+	}
+	cert, err := signUserKey(issuer, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Key.Type() != "sk-ssh-ed25519@openssh.com" || !bytes.Equal(cert.Key.Marshal(), skKey.Marshal()) {
+		t.Errorf("certificate is for key type %s, not the security key", cert.Key.Type())
+	}
+	checker := ssh.CertChecker{}
+	if err := checker.CheckCert("web", cert); err != nil {
+		t.Errorf("certificate check failed: %s", err)
+	}
+}
+
+// each key type is generated, certified and added to an agent, whose
+// certificate signer then works
+func TestAddCertToAgentKeyTypes(t *testing.T) {
+	issuer := newTestIssuer(t)
+	userKey := newTestSigner(t)
+	for _, keyType := range util.KeyTypes() {
+		t.Run(keyType, func(t *testing.T) {
+			keyring := agent.NewKeyring()
+			req := &certRequest{
+				user:     &util.UserPrincipals{Name: "tester"},
+				key:      &util.UserKey{PublicKey: userKey.PublicKey(), Fingerprint: ssh.FingerprintSHA256(userKey.PublicKey())},
+				spec:     &util.CertSpec{Principals: []string{"web"}, Validity: 30, KeyType: keyType},
+				settings: &util.Settings{Organisation: "testorg"},
+				conn:     testConnMetadata{},
+			}
+			if _, err := addCertToAgent(keyring.(agent.ExtendedAgent), issuer, req); err != nil {
+				t.Fatal(err)
+			}
+
+			signers, err := keyring.Signers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var certSigner ssh.Signer
+			for _, s := range signers {
+				if _, ok := s.PublicKey().(*ssh.Certificate); ok {
+					certSigner = s
+				}
+			}
+			if certSigner == nil {
+				t.Fatal("no certificate in agent")
+			}
+			cert := certSigner.PublicKey().(*ssh.Certificate)
+			if want := keyTypeNames[keyType]; cert.Key.Type() != want {
+				t.Errorf("got key type %s want %s", cert.Key.Type(), want)
+			}
+
+			data := []byte("test data")
+			sig, err := certSigner.Sign(rand.Reader, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cert.Key.Verify(data, sig); err != nil {
+				t.Errorf("signature by agent key did not verify: %s", err)
+			}
+		})
+	}
+}
+
+// keyTypeNames are the ssh key types of each key_type
+var keyTypeNames = map[string]string{
+	"ed25519":    ssh.KeyAlgoED25519,
+	"ecdsa-p256": ssh.KeyAlgoECDSA256,
+	"ecdsa-p384": ssh.KeyAlgoECDSA384,
+	"rsa-3072":   ssh.KeyAlgoRSA,
+	"rsa-4096":   ssh.KeyAlgoRSA,
+}
+
+// custom extension values are rendered for the user in certificates
+func TestSignCustomExtensions(t *testing.T) {
+	settings, err := util.SettingsLoad("util/testdata/settings_extensions.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := settings.Users[0]
+	spec, err := settings.CertSpec(user, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &certRequest{user: user, key: user.Keys[0], spec: spec, settings: &settings, conn: testConnMetadata{}}
+	cert, err := signUserKey(newTestIssuer(t), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cert.Extensions["login@github.com"]; got != "alice-admin" {
+		t.Errorf("got login@github.com extension %q", got)
+	}
+	if got := spec.Extensions["login@github.com"]; got != "{{.Name}}-{{.Profile}}" {
+		t.Errorf("spec extensions changed to %q", got)
+	}
+}
+
+// templated principals and key ids are rendered in certificates
+func TestSignTemplates(t *testing.T) {
+	settings, err := util.SettingsLoad("util/testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := settings.Users[0]
+	spec, err := settings.CertSpec(user, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &certRequest{user: user, key: user.Keys[0], spec: spec, settings: &settings, conn: testConnMetadata{}}
+	cert, err := signUserKey(newTestIssuer(t), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("acmeinc:alice:admin:%d", cert.Serial); cert.KeyId != want {
+		t.Errorf("got key id %q want %q", cert.KeyId, want)
+	}
+	if want := []string{"alice-admin", "ALICE"}; !slices.Equal(cert.ValidPrincipals, want) {
+		t.Errorf("got principals %v want %v", cert.ValidPrincipals, want)
+	}
+}
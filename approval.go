@@ -0,0 +1,301 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorycl/sshagentca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+var (
+	errApprovalDenied    = errors.New("certificate request denied")
+	errApprovalTimeout   = errors.New("certificate request was not approved in time")
+	errApprovalAbandoned = errors.New("certificate request abandoned")
+	errSelfApproval      = errors.New("users may not approve their own requests")
+)
+
+// pendingApproval is a certificate request waiting for approval
+type pendingApproval struct {
+	id         uint64
+	user       string
+	profile    string
+	principals []string
+	remoteAddr string
+	reason     string
+	requested  time.Time
+	decision   chan string // the approver, or empty if denied
+}
+
+// String describes the request for approvers
+func (p *pendingApproval) String() string {
+	s := fmt.Sprintf("%d %s", p.id, p.user)
+	if p.profile != "" {
+		s = fmt.Sprintf("%s profile %s", s, p.profile)
+	}
+	s = fmt.Sprintf("%s principals %s from %s waiting %s", s,
+		strings.Join(p.principals, ","), p.remoteAddr, time.Since(p.requested).Round(time.Second))
+	if p.reason != "" {
+		s = fmt.Sprintf("%s reason %q", s, p.reason)
+	}
+	return s
+}
+
+// approvals holds the certificate requests waiting for approval
+type approvals struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]*pendingApproval
+}
+
+func newApprovals() *approvals {
+	return &approvals{pending: map[uint64]*pendingApproval{}}
+}
+
+// add a pending request for the certificate request
+func (a *approvals) add(req *certRequest) *pendingApproval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next++
+	p := &pendingApproval{
+		id:         a.next,
+		user:       req.user.Name,
+		profile:    req.spec.Profile,
+		principals: req.spec.Principals,
+		remoteAddr: req.conn.RemoteAddr().String(),
+		reason:     req.reason,
+		requested:  time.Now(),
+		decision:   make(chan string, 1),
+	}
+	a.pending[p.id] = p
+	return p
+}
+
+// list returns the pending requests in the order they were made
+func (a *approvals) list() []*pendingApproval {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := []*pendingApproval{}
+	for _, p := range a.pending {
+		pending = append(pending, p)
+	}
+	slices.SortFunc(pending, func(x, y *pendingApproval) int { return cmp.Compare(x.id, y.id) })
+	return pending
+}
+
+// decide approves or denies the pending request id on behalf of
+// approver, who may not decide their own requests
+func (a *approvals) decide(id uint64, approver string, approved bool) (*pendingApproval, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.pending[id]
+	if !ok {
+		return nil, fmt.Errorf("no pending request %d", id)
+	}
+	if p.user == approver {
+		return nil, errSelfApproval
+	}
+	delete(a.pending, id)
+	if approved {
+		p.decision <- approver
+	} else {
+		p.decision <- ""
+	}
+	return p, nil
+}
+
+// wait for the pending request to be decided, returning the approver.
+// The request is withdrawn if it is not decided within timeout or done
+// is closed.
+func (a *approvals) wait(p *pendingApproval, timeout time.Duration, done <-chan struct{}) (string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case approver := <-p.decision:
+		if approver == "" {
+			return "", errApprovalDenied
+		}
+		return approver, nil
+	case <-timer.C:
+		err = errApprovalTimeout
+	case <-done:
+		err = errApprovalAbandoned
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, p.id)
+	// the request may have been decided while being withdrawn
+	select {
+	case approver := <-p.decision:
+		if approver == "" {
+			return "", errApprovalDenied
+		}
+		return approver, nil
+	default:
+	}
+	return "", err
+}
+
+// awaitApproval asks for approval of the certificate request, telling
+// the user on the terminal, and waits for it to be decided. The
+// request is withdrawn if the client disconnects.
+func awaitApproval(t *term.Terminal, sshConn *ssh.ServerConn, a *approvals, req *certRequest) (string, error) {
+	done := make(chan struct{})
+	go func() {
+		_ = sshConn.Wait()
+		close(done)
+	}()
+	p := a.add(req)
+	timeout := req.settings.ApprovalTimeout()
+	log.Printf("user %s requested approval %d for principals %s", req.user.Name, p.id, req.spec.Principals)
+	termWriter(t, fmt.Sprintf("principals %s require approval", strings.Join(req.spec.Principals, ",")))
+	termWriter(t, fmt.Sprintf("waiting up to %s for approval of request %d", timeout, p.id))
+	return a.wait(p, timeout, done)
+}
+
+// approvalHelp describes the approver commands
+const approvalHelp = `commands:
+  list               list pending requests
+  approve <request>  approve a request
+  deny <request>     deny a request
+  quit               disconnect`
+
+// runApprovalCommand runs an approver command, writing the results to w
+func runApprovalCommand(w io.Writer, a *approvals, approver string, line string) error {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		pending := a.list()
+		if len(pending) == 0 {
+			fmt.Fprintln(w, "no pending requests")
+		}
+		for _, p := range pending {
+			fmt.Fprintln(w, p)
+		}
+		return nil
+	case "approve", "deny":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s <request>", args[0])
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid request %s", args[1])
+		}
+		approved := args[0] == "approve"
+		p, err := a.decide(id, approver, approved)
+		if err != nil {
+			return err
+		}
+		if approved {
+			log.Printf("user %s approved request %d by %s for principals %s", approver, id, p.user, p.principals)
+			fmt.Fprintf(w, "approved request %d by %s\n", id, p.user)
+		} else {
+			log.Printf("user %s denied request %d by %s for principals %s", approver, id, p.user, p.principals)
+			fmt.Fprintf(w, "denied request %d by %s\n", id, p.user)
+		}
+		return nil
+	case "help":
+		fmt.Fprintln(w, approvalHelp)
+		return nil
+	}
+	return fmt.Errorf("unknown command %s", args[0])
+}
+
+// handleApprover services the session of an approver, who may run a
+// single command with exec, such as `ssh approve@sshagentca list`, or
+// commands in an interactive shell. started is called once the session
+// has been set up. The session is closed if ctx is cancelled.
+func handleApprover(ctx context.Context, chans <-chan ssh.NewChannel, sshConn *ssh.ServerConn, started func(),
+	approver *util.UserPrincipals, settings *util.Settings, a *approvals) {
+
+	defer sshConn.Close()
+	defer closeOnShutdown(ctx, sshConn, approver.Name)()
+
+	for thisChan := range chans {
+		if thisChan.ChannelType() != "session" {
+			_ = thisChan.Reject(ssh.Prohibited, "channel type is not a session")
+			return
+		}
+		ch, reqs, err := thisChan.Accept()
+		if err != nil {
+			log.Println("did not accept channel request", err)
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			switch req.Type {
+			case "pty-req", "env":
+				if req.WantReply {
+					_ = req.Reply(true, nil)
+				}
+				continue
+			case "exec":
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					_ = req.Reply(false, nil)
+					return
+				}
+				if req.WantReply {
+					_ = req.Reply(true, nil)
+				}
+				started()
+				err := runApprovalCommand(ch, a, approver.Name, payload.Command)
+				if err != nil {
+					fmt.Fprintln(ch.Stderr(), err)
+				}
+				chanCloser(ch, err != nil)
+				return
+			case "shell":
+				if req.WantReply {
+					_ = req.Reply(true, nil)
+				}
+				started()
+				approverShell(ch, a, approver.Name, settings)
+				chanCloser(ch, false)
+				return
+			}
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+		return
+	}
+}
+
+// approverShell runs approver commands read from the terminal until the
+// approver quits
+func approverShell(ch ssh.Channel, a *approvals, approver string, settings *util.Settings) {
+	t := term.NewTerminal(ch, "approve> ")
+	termWriter(t, settings.Banner)
+	termWriter(t, fmt.Sprintf("welcome, %s", approver))
+	termWriter(t, approvalHelp)
+	_ = runApprovalCommand(t, a, approver, "list")
+	for {
+		line, err := t.ReadLine()
+		if err != nil {
+			return
+		}
+		if cmd := strings.TrimSpace(line); cmd == "quit" || cmd == "exit" {
+			termWriter(t, "goodbye")
+			return
+		}
+		if err := runApprovalCommand(t, a, approver, line); err != nil {
+			termWriter(t, err.Error())
+		}
+	}
+}
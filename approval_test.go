@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/sshagentca/util"
+)
+
+// testApprovalRequest makes a certificate request by user for root
+func testApprovalRequest(user string) *certRequest {
+	return &certRequest{
+		user: &util.UserPrincipals{Name: user},
+		spec: &util.CertSpec{Profile: "prod", Principals: []string{"root"}, RequireApproval: true},
+		conn: testConnMetadata{},
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	a := newApprovals()
+	never := make(chan struct{})
+
+	// approved by another user
+	p := a.add(testApprovalRequest("jane"))
+	if _, err := a.decide(p.id, "jane", true); !errors.Is(err, errSelfApproval) {
+		t.Errorf("self approval got error %v", err)
+	}
+	if _, err := a.decide(p.id, "john", true); err != nil {
+		t.Fatal(err)
+	}
+	approver, err := a.wait(p, time.Second, never)
+	if err != nil || approver != "john" {
+		t.Errorf("got approver %q error %v", approver, err)
+	}
+	if _, err := a.decide(p.id, "john", true); err == nil {
+		t.Error("request decided twice")
+	}
+
+	// denied
+	p = a.add(testApprovalRequest("jane"))
+	if _, err := a.decide(p.id, "john", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.wait(p, time.Second, never); !errors.Is(err, errApprovalDenied) {
+		t.Errorf("denied request got error %v", err)
+	}
+
+	// timed out and abandoned requests are withdrawn
+	p = a.add(testApprovalRequest("jane"))
+	if _, err := a.wait(p, 10*time.Millisecond, never); !errors.Is(err, errApprovalTimeout) {
+		t.Errorf("timed out request got error %v", err)
+	}
+	done := make(chan struct{})
+	close(done)
+	p = a.add(testApprovalRequest("jane"))
+	if _, err := a.wait(p, time.Second, done); !errors.Is(err, errApprovalAbandoned) {
+		t.Errorf("abandoned request got error %v", err)
+	}
+	if pending := a.list(); len(pending) != 0 {
+		t.Errorf("requests not withdrawn %v", pending)
+	}
+}
+
+func TestRunApprovalCommand(t *testing.T) {
+	a := newApprovals()
+	a.add(testApprovalRequest("jane"))
+	a.add(testApprovalRequest("john"))
+
+	tests := []struct {
+		line   string
+		output string
+		err    string
+	}{
+		{"", "1 jane profile prod principals root from 127.0.0.1:2222", ""},
+		{"list", "2 john profile prod principals root", ""},
+		{"approve 1", "approved request 1 by jane", ""},
+		{"approve 2", "", "users may not approve their own requests"},
+		{"deny 2 3", "", "usage: deny <request>"},
+		{"deny x", "", "invalid request x"},
+		{"deny 3", "", "no pending request 3"},
+		{"help", "approve <request>", ""},
+		{"sudo", "", "unknown command sudo"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := runApprovalCommand(&out, a, "john", tt.line)
+		if !util.ErrorContains(err, tt.err) {
+			t.Errorf("%q got error %v want %s", tt.line, err, tt.err)
+		}
+		if !strings.Contains(out.String(), tt.output) {
+			t.Errorf("%q got output %q want %q", tt.line, out.String(), tt.output)
+		}
+	}
+}
@@ -25,7 +25,7 @@ this out):
 	$ ssh-add -l
 	  256 SHA256:Ye3VV0z4vDvAuiZYqw4ji2Ht/JlDTMNlpTZoeZR+bDs briony@test.com (ED25519)
 
-	$ ssh -A -p 2222 127.0.0.1
+	$ ssh -A -T -p 2222 127.0.0.1
 	  acmeinc ssh user certificate service
 
 	  welcome, briony
@@ -35,7 +35,7 @@ this out):
 
 	$ ssh-add -l
 	  256 SHA256:Ye3VV0z4vDvAuiZYqw4ji2Ht/JlDTMNlpTZoeZR+bDs briony@test.com (ED25519)
-	  256 SHA256:wfFD6xj3qGNCli3WkRda8SMbRP6WwleZWU9dt9oJDZw acmeinc_briony_from:2022-05-24T06:06_to:2022-05-24T09:06UTC (ED25519-CERT)
+	  256 SHA256:wfFD6xj3qGNCli3WkRda8SMbRP6WwleZWU9dt9oJDZw acmeinc_briony_from:2022-05-24T06:06_to:2022-05-24T09:06UTC_serial:1 (ED25519-CERT)
 
 	$ ssh -p 48084 root@127.0.0.1
 	  Welcome to Alpine!
@@ -43,7 +43,68 @@ this out):
 	  fd54c3009dc2:~# exit
 
 The login username that the client provides when connecting to `sshagentca`
-is ignored - it does not have to match the `name:` in `settings.yaml`.
+does not have to match the `name:` in `settings.yaml`. It is ignored
+unless it names one of the user's `profiles`, in which case the
+certificate is issued with that profile's principals, validity and
+extensions. For example `ssh -A prod@sshagentca` can give a user a
+short-lived elevated certificate while `ssh -A sshagentca` gives their
+default one. Connecting with the name of a profile the user does not
+have is refused.
+
+Profiles with `require_reason: true` ask the user for the reason they
+need the certificate, such as a ticket number, before it is issued. The
+reason must be printable text of up to 128 characters, wholly matching
+the regular expression `reason_pattern` if that is set. The reason is
+logged, recorded in the ledger and added to the certificate key id as
+`_reason:<reason>` so that it shows in sshd's logs. A `key_id` template
+must include `{{.Reason}}` if any profile requires a reason.
+
+Certificates with privileged principals can require a second person's
+approval with an `approval` section listing the `principals` concerned,
+the users who are `approvers` and a `timeout` in minutes, by default 5:
+
+	approval:
+	    principals: [root]
+	    approvers: [jane, john]
+
+A user requesting such a certificate waits in their session while the
+request is pending. Approvers connect with the `approve` username to
+list, approve and deny requests, either interactively with
+`ssh approve@sshagentca` or with a single command such as
+`ssh approve@sshagentca approve 3`. Approvers may not approve their own
+requests. Requests not decided within the timeout, or whose user
+disconnects, are withdrawn. The approver is logged and recorded in the
+ledger as `approved_by`. No profile may be named `approve`.
+
+Clients may run a command in their session. `issue`, the default for
+an interactive session, issues a certificate, `whoami` shows the user,
+key, profiles, groups and the principals and validity of their
+certificate, and `status` shows whether a certificate can be issued now
+and when it would expire. Agent forwarding and a command can be asked
+for together, for example `ssh -A sshagentca issue`. With `--json`, as
+in `ssh sshagentca status --json`, the results or an error are written
+as json on stdout and any messages or prompts on stderr. Commands which
+fail exit with status 1.
+
+Clients may also ask for only some of their principals and a shorter
+validity than their maximum, for example
+`ssh -A sshagentca issue --principals web --validity 15m`. The validity
+is in minutes or a duration such as `1h`. The same can be requested in
+an interactive session with the environment variables
+`SSHAGENTCA_PRINCIPALS` and `SSHAGENTCA_VALIDITY`, sent with
+`ssh -o SendEnv=SSHAGENTCA_*`. Requests for principals or a validity
+beyond the user's entitlement are refused. Approval is only needed if
+the requested principals require it.
+
+Users connecting interactively with a terminal, as with
+`ssh -A sshagentca`, are shown a menu of the principals they are
+entitled to and the validity of their certificate. They may include or
+exclude principals by number, choose a shorter validity with
+`validity 15m`, switch to another of their profiles with
+`profile <name>`, and press enter to issue the certificate or enter
+`quit` to cancel. Sessions without a terminal, such as `ssh -A -T
+sshagentca` or those running a command, are issued a certificate
+without the menu as before.
 
 Certificates from sshagentca can be conveniently used with pam-ussh (see
 https://github.com/uber/pam-ussh) to control sudo privileges on suitably
@@ -68,8 +129,73 @@ the prompt received by the client. Users are configured in the
 `user_principals` section, where each user is required to have a name,
 ssh public key and list of principals to be set out.
 
+A user with several keys, for example a laptop key and a hardware token
+key, lists them under `sshpublickeys` rather than `sshpublickey`. Each
+entry is a key, or a `key` with a `label` which is shown in the server
+log, the ledger and the certificate key id, for example
+`acmeinc_jane_laptop_from:...`:
+
+	sshpublickeys:
+	    - key: "ssh-ed25519 AAAA... jane@laptop"
+	      label: laptop
+	    - "sk-ssh-ed25519@openssh.com AAAA... jane@token"
+
+Users may also be kept in separate files, for example so that team
+leads can manage their own users through configuration management.
+`users_dir` names a directory, relative to the settings file if not
+absolute, whose `.yaml` and `.yml` files each hold a `user_principals`
+list in the same form as the settings file:
+
+	users_dir: /etc/sshagentca/users.d/
+
+The users in these files are added to those in the settings file.
+Errors in a user's settings are reported with the file and line at
+which the user is defined, and a user name or key may not appear in
+more than one file. When the settings are reloaded the users directory
+is read again.
+
 The server will run on the specified IP address and port, by default
-0.0.0.0:2222.
+0.0.0.0:2222. Connections are serviced concurrently, up to a limit set by
+`--maxConns` (default 64). Clients that do not complete the ssh
+handshake within `--handshakeTimeout` (default 10s), or that do not
+then start a session within the same time again, are disconnected.
+
+On SIGINT or SIGTERM the server stops accepting connections and waits up
+to `--shutdownTimeout` (default 30s) for connections in flight to finish
+issuing certificates before exiting, which allows rolling restarts.
+Connections waiting for input from their users, such as for a reason,
+an approval, a choice in the certificate menu or an approver's command,
+are closed at once. A second SIGINT or SIGTERM exits immediately.
+
+Sending SIGHUP to the server reloads `settings.yaml` without restarting
+the listener or re-entering key passwords. The server can also check
+the file for changes every `--reloadInterval`. New settings are only
+used if they load and validate successfully; otherwise the existing
+settings are kept. The changes made by a reload are logged.
+
+Each certificate is given a unique serial number, which is shown in the
+server log and the certificate's agent comment. The last serial number
+issued is saved in `--serialFile` (default `sshagentca.serial`) so that
+serial numbers continue to increase across restarts.
+
+Every certificate issued is recorded in the ledger file `--ledgerFile`
+(default `sshagentca.ledger`) before it is added to the user's agent.
+Each json line records the serial, key id, user name, user key
+fingerprint and label, principals, validity period, extensions and the
+client's remote address and ssh version. The ledger can be listed and filtered
+with the ledger subcommand, for example:
+
+	sshagentca ledger -l sshagentca.ledger --user jane --since 2026-01-01
+
+Certificates can be revoked by serial number, key id or the fingerprint
+of the user key used to obtain them with the revoke subcommand. This
+records the revocation in `--revocationsFile` and writes an OpenSSH key
+revocation list (KRL) built from the ledger and all recorded
+revocations to `--krlFile`, for use with the sshd `RevokedKeys` setting.
+For example:
+
+	sshagentca revoke -a ca.pub --serial 42 --reason "lost laptop"
+	ssh-keygen -Q -f sshagentca.krl user-cert.pub
 
 If the server runs successfully, it will respond to ssh connections that
 have a public key listed in `user_principals` section and which have a
@@ -78,8 +204,33 @@ into the forwarded agent which is signed by `caprivatekey` with the
 parameters set out in `settings.yaml` and restrictions as noted below.
 
 sshagentca generates a new key and corresponding certificate to insert
-into the client's ssh-agent, signed using ed25519 keys. The CA key you
-provide to sign the certificate may be a different key.
+into the client's ssh-agent. The generated key is an ed25519 key unless
+`key_type` is set, globally or for a group, user or profile, to one of
+`ed25519`, `ecdsa-p256`, `ecdsa-p384`, `rsa-3072` or `rsa-4096`, for
+servers whose sshd does not accept ed25519 keys. The CA key you provide
+to sign the certificate may be a different type of key.
+
+Users with `sign_user_key: true` are instead given a certificate for the
+public key they authenticated with, so that certificates for FIDO `sk-`
+keys, whose private keys never leave the hardware token, keep the
+requirement for the token to be present. These users do not need to
+forward an agent. The ssh agent protocol requires the private key to be
+added with a certificate, so the certificate cannot be added to the
+agent; it is shown in the session to be saved next to the key, for
+example as `~/.ssh/id_ed25519_sk-cert.pub`, where ssh will find it.
+
+A second factor may be required by setting `totp_secrets` to a yaml
+file, readable only by its owner, mapping each user's name to the
+base32 secret of their authenticator app:
+
+	jane: JBSWY3DPEHPK3PXPJBSWY3DP
+
+Every user must then have a secret. After authenticating with their
+key, users are asked by keyboard-interactive authentication for a
+`Verification code`, a six digit RFC 6238 TOTP code, before a
+certificate is issued. Each code may only be used once. A user who
+gives 5 invalid codes within 15 minutes, over any connections, is
+refused further codes until the earliest of these is 15 minutes old.
 
 Clients can authenticate to sshagentca using any key type supported by
 go's `x/crypto/ssh` package, including ed25519 keys introduced in go
@@ -96,18 +247,133 @@ these could be easily added.
 
 With reference to
 https://cvsweb.openbsd.org/src/usr.bin/ssh/PROTOCOL.certkeys?annotate=HEAD
-there is no support presently for customising *critical options*, and
-only the standard *extensions*, such as `permit-agent-forwarding`,
-`permit-port-forwarding` and `permit-pty` are permitted.
+only the `force-command` and `source-address` *critical options* are
+supported, and only the standard *extensions*, such as
+`permit-agent-forwarding`, `permit-port-forwarding` and `permit-pty`
+are permitted, together with any vendor extensions listed in
+`custom_extensions`.
+
+Vendor extensions, such as `login@github.com`, have names in
+`name@domain` form and may have values. Each is listed in
+`custom_extensions` with an optional `pattern`, a regular expression
+which its values must wholly match. Values may include the user's name
+or the selected profile with `{{.Name}}` and `{{.Profile}}`, and are
+checked for every user when the settings are loaded. For example:
+
+	custom_extensions:
+	    login@github.com:
+	        pattern: "[A-Za-z0-9-]+"
+	extensions:
+	    permit-pty: ""
+	    login@github.com: "{{.Name}}"
+
+Critical options are set in the `critical_options` section of the
+settings file, for all users, or for individual users or profiles,
+whose critical options override those set globally by name. For
+example, to restrict certificates to use from office and VPN networks:
+
+	critical_options:
+	    source-address: "192.0.2.0/24,198.51.100.0/24"
+
+`source-address` must be a comma separated list of addresses or
+networks in CIDR format, which is checked when the settings are loaded.
+
+Users and profiles may also have `bind_source_address` set, which sets
+the `source-address` of their certificates to the address they
+connected to sshagentca from, so that a certificate taken from their
+agent cannot be used from another network. This is off by default. The
+address may be widened to a network with `ipv4_prefix` and
+`ipv6_prefix`, for example:
+
+	bind_source_address:
+	    ipv4_prefix: 24
+
+If a `source-address` is also configured, certificates are refused to
+clients connecting from outside it, and the bound network is narrowed
+to the configured network if that is smaller.
 
 Each certificate's principals settings are taken from the principals set
 out for the specific connecting client public key from the
 `user_principals` settings.
 
+Principals can also be managed with the top-level `groups` section,
+which maps group names to principals and optionally `validity`,
+`extensions` and `critical_options`. Users list their `groups` instead
+of, or as well as, their own principals. Groups may include other
+groups. Unknown group names and cycles of groups are reported when the
+settings are loaded. For example:
+
+	groups:
+	    webteam:
+	        principals: [web]
+	    oncall:
+	        principals: [root]
+	        groups: [webteam]
+	        validity: 30
+
+A user's certificate has the user's principals and those of all their
+groups. The shortest validity set by their groups and the combined
+group extensions and critical options are used, unless overridden for
+the user.
+
+Principals may be templates which are rendered for each user, using
+the user's name as `{{.Name}}`, the selected profile as `{{.Profile}}`
+and, for group principals only, the name of the group as `{{.Group}}`.
+The functions `lower`, `upper`, `trim`, `replace`, `printf`, `len`, `eq`,
+`ne`, `and`, `or` and `not` and `if` actions may be used. Templates may
+not loop or define or include other templates, and are checked for every
+user and profile when the settings are loaded. For example:
+
+	groups:
+	    webteam:
+	        principals: ["team-{{.Group}}", "{{.Name}}-web"]
+
+The certificate key id, which is shown in sshd logs, is
+`organisation_name[_label][_profile]_from:..._to:...` unless a `key_id`
+template is set, which may also use `{{.Organisation}}`, the key
+`{{.Label}}`, the certificate `{{.Serial}}` and its validity `{{.From}}`
+and `{{.To}}`:
+
+	key_id: "{{.Organisation}}:{{.Name}}{{if .Profile}}:{{.Profile}}{{end}}:{{.Serial}}"
+
+Certificates can be limited to named `access_windows`, each a range of
+hours on some days of the week in a timezone, for example:
+
+	access_windows:
+	    business_hours:
+	        timezone: Europe/London
+	        days: [mon, tue, wed, thu, fri]
+	        hours: "09:00-18:00"
+
+Groups, users and profiles may then list the `access_windows` during
+which their certificates are issued. The windows of a user's groups are
+combined, and a group with an empty list such as `access_windows: []`
+lifts the restriction, so that a user in an on call group can obtain
+a certificate at any time. Outside the windows a request is refused
+with a message explaining when certificates are issued. Certificates
+issued within a window expire when the window closes.
+
 The `valid after` timestamp in the generated certificates is set
 according to the `validity` settings parameter, specified in minutes.
 A `validity` duration of 24 hours or more is not permitted.
 
+Each user, and each user profile, may override the global `validity`,
+`extensions` and `critical_options` settings. Profiles inherit the
+settings of their user. An overriding `validity` may not exceed the
+24 hour maximum.
+
+A user's account may be limited to a period with `valid_from` and
+`valid_until`, given as dates or as timestamps, for example for a
+contractor:
+
+	valid_from: 2026-01-05
+	valid_until: 2026-06-30
+
+Dates are taken to be midnight UTC, so the user above is refused from
+the start of 30 June 2026. Certificates are not issued outside the
+period, and a certificate issued near the end of the period expires at
+`valid_until` rather than outliving the account.
+
 ## Key generation
 
 To generate new server keys, refer to man ssh-keygen. For example:
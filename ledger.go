@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/sshagentca/util"
+)
+
+const ledgerUsage = `ledger <options>
+
+List certificates recorded in the sshagentca issuance ledger, optionally
+filtered by user, principal or issue time. Times may be given in RFC3339
+format or as a date, e.g. 2006-01-02.
+
+Application Arguments:
+
+ `
+
+// LedgerOptions are the command line options for the ledger subcommand
+type LedgerOptions struct {
+	LedgerFile string `short:"l" long:"ledgerFile" default:"sshagentca.ledger" description:"certificate ledger file"`
+	User       string `short:"u" long:"user" description:"only list certificates issued to user"`
+	Principal  string `short:"n" long:"principal" description:"only list certificates including principal"`
+	Since      string `long:"since" description:"only list certificates issued at or after this time"`
+	Until      string `long:"until" description:"only list certificates issued before this time"`
+	JSON       bool   `long:"json" description:"list entries as json lines"`
+}
+
+// parseTimeArg parses a command line time in RFC3339 or date format
+func parseTimeArg(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, expected RFC3339 or YYYY-MM-DD", s)
+	}
+	return t, nil
+}
+
+// ledgerCommand lists ledger entries
+func ledgerCommand(args []string) error {
+
+	var options LedgerOptions
+	var parser = flags.NewParser(&options, flags.Default)
+	parser.Usage = ledgerUsage
+	if _, err := parser.ParseArgs(args); err != nil {
+		return err
+	}
+
+	var err error
+	filter := util.LedgerFilter{User: options.User, Principal: options.Principal}
+	if filter.From, err = parseTimeArg(options.Since); err != nil {
+		return err
+	}
+	if filter.To, err = parseTimeArg(options.Until); err != nil {
+		return err
+	}
+
+	entries, err := util.ReadLedger(options.LedgerFile)
+	if err != nil {
+		return err
+	}
+
+	if options.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range entries {
+			if filter.Match(e) {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIAL\tISSUED\tUSER\tFINGERPRINT\tPRINCIPALS\tVALID BEFORE\tREMOTE ADDRESS")
+	for _, e := range entries {
+		if !filter.Match(e) {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Serial,
+			e.Issued.UTC().Format(time.RFC3339),
+			e.User,
+			e.Fingerprint,
+			strings.Join(e.Principals, ","),
+			e.ValidBefore.UTC().Format(time.RFC3339),
+			e.RemoteAddr,
+		)
+	}
+	return tw.Flush()
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	flags "github.com/jessevdk/go-flags"
 	"github.com/rorycl/sshagentca/util"
@@ -22,6 +27,8 @@ An SSH server forwarded agent client certificate authority
     sshagentca -h
     sshagentca -t <privatekey> -c <caprivatekey> -i <ipaddress> -p <port>
                <settings.yaml>
+    sshagentca ledger -h
+    sshagentca revoke -h
 
 The environmental variables SSHAGENTCA_PVT_KEY and SSHAGENTCA_CA_KEY may
 be used for the privatekey passwords. The server private key password is
@@ -33,15 +40,28 @@ Application Arguments:
 
 // Options are the command line options
 type Options struct {
-	PrivateKey   string `short:"t" long:"privateKey" required:"true" description:"server ssh private key (optionally password protected)"`
-	CAPrivateKey string `short:"c" long:"caPrivateKey" description:"certificate authority private key file (password protected)"`
-	IPAddress    string `short:"i" long:"ipAddress" default:"0.0.0.0" description:"ipaddress"`
-	Port         string `short:"p" long:"port" default:"2222" description:"port"`
-	Args         struct {
+	PrivateKey       string        `short:"t" long:"privateKey" required:"true" description:"server ssh private key (optionally password protected)"`
+	CAPrivateKey     string        `short:"c" long:"caPrivateKey" description:"certificate authority private key file (password protected)"`
+	IPAddress        string        `short:"i" long:"ipAddress" default:"0.0.0.0" description:"ipaddress"`
+	Port             string        `short:"p" long:"port" default:"2222" description:"port"`
+	HandshakeTimeout time.Duration `long:"handshakeTimeout" default:"10s" description:"time allowed for a client to complete the ssh handshake, and then to start a session"`
+	MaxConns         int           `long:"maxConns" default:"64" description:"maximum number of concurrent client connections"`
+	ShutdownTimeout  time.Duration `long:"shutdownTimeout" default:"30s" description:"time allowed for certificates being issued to complete on shutdown"`
+	ReloadInterval   time.Duration `long:"reloadInterval" default:"0s" description:"interval at which to check the settings file for changes (0 to only reload on SIGHUP)"`
+	SerialFile       string        `long:"serialFile" default:"sshagentca.serial" description:"file recording the last certificate serial number issued"`
+	LedgerFile       string        `long:"ledgerFile" default:"sshagentca.ledger" description:"file recording each certificate issued"`
+	Args             struct {
 		Settings string `description:"settings yaml file"`
 	} `positional-args:"yes" required:"yes"`
 }
 
+// subcommands are run instead of the server when named as the first
+// argument
+var subcommands = map[string]func(args []string) error{
+	"ledger": ledgerCommand,
+	"revoke": revokeCommand,
+}
+
 func hardexit(msg string) {
 	fmt.Printf("\n\n> %s\n\nAborting startup.\n", msg)
 	os.Exit(1)
@@ -49,6 +69,18 @@ func hardexit(msg string) {
 
 func main() {
 
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				if _, ok := err.(*flags.Error); !ok {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+				}
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	var err error
 	var options Options
 	var parser = flags.NewParser(&options, flags.Default)
@@ -114,10 +146,54 @@ func main() {
 		hardexit(fmt.Sprintf("Settings could not be loaded : %s", err))
 	}
 
+	// load certificate serial number counter
+	serials, err := util.NewSerialAllocator(options.SerialFile)
+	if err != nil {
+		hardexit(fmt.Sprintf("Serial file could not be loaded: %s", err))
+	}
+
+	// open certificate ledger
+	ledger, err := util.OpenLedger(options.LedgerFile)
+	if err != nil {
+		hardexit(fmt.Sprintf("Ledger file could not be opened: %s", err))
+	}
+	defer ledger.Close()
+
 	// check ip
 	if net.IP(options.IPAddress) == nil {
 		hardexit(fmt.Sprintf("Invalid ip address %s", options.IPAddress))
 	}
 
-	Serve(options, privateKey, caKey, settings)
+	// check connection limits
+	if options.HandshakeTimeout <= 0 {
+		hardexit(fmt.Sprintf("Invalid handshake timeout %s", options.HandshakeTimeout))
+	}
+	if options.MaxConns < 1 {
+		hardexit(fmt.Sprintf("Invalid maximum connections %d", options.MaxConns))
+	}
+	if options.ShutdownTimeout < 0 {
+		hardexit(fmt.Sprintf("Invalid shutdown timeout %s", options.ShutdownTimeout))
+	}
+
+	// stop accepting connections on SIGINT or SIGTERM, allowing those in
+	// flight to finish. A second signal terminates the process at once.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	// reload settings on SIGHUP or file change
+	live := newLiveSettings(options.Args.Settings, settings)
+	go watchReload(ctx, live, options.ReloadInterval)
+
+	issuer := &certIssuer{caKey: caKey, serials: serials, ledger: ledger, approvals: newApprovals()}
+	err = Serve(ctx, options, privateKey, issuer, live)
+	if err != nil {
+		log.Printf("server error: %s", err)
+		stop()
+		os.Exit(1)
+	}
+	log.Println("server shut down")
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rorycl/sshagentca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// pickTimeout is the time a user has to choose their certificate in the
+// interactive menu before the connection is closed
+const pickTimeout = 5 * time.Minute
+
+var (
+	errPickCancelled = errors.New("certificate request cancelled")
+	errPickNone      = errors.New("choose at least one principal")
+)
+
+// pickerHelp describes the interactive menu commands
+const pickerHelp = `enter a number to include or exclude a principal, or
+  all                 include all principals
+  none                exclude all principals
+  validity <minutes>  choose the validity, such as 15 or 1h
+  profile [name]      choose a profile, or the default settings
+  issue               issue the certificate, also by pressing enter
+  quit                cancel`
+
+// picker is an interactive menu in which users choose the principals
+// and validity of their certificate from those they are entitled to
+type picker struct {
+	settings *util.Settings
+	user     *util.UserPrincipals
+	spec     *util.CertSpec // the entitlement of the chosen profile
+	selected []bool         // by principal of spec
+	validity uint32
+}
+
+// newPicker makes a menu for user's entitlement spec, starting with the
+// principals and validity of chosen
+func newPicker(settings *util.Settings, user *util.UserPrincipals, spec, chosen *util.CertSpec) *picker {
+	p := &picker{settings: settings, user: user}
+	p.setSpec(spec)
+	for i, principal := range spec.Principals {
+		p.selected[i] = slices.Contains(chosen.Principals, principal)
+	}
+	p.validity = chosen.Validity
+	return p
+}
+
+// setSpec sets the entitlement, selecting all its principals and its
+// full validity
+func (p *picker) setSpec(spec *util.CertSpec) {
+	p.spec = spec
+	p.selected = make([]bool, len(spec.Principals))
+	for i := range p.selected {
+		p.selected[i] = true
+	}
+	p.validity = spec.Validity
+}
+
+// show the menu
+func (p *picker) show(w io.Writer) {
+	profile := p.spec.Profile
+	if profile == "" {
+		profile = "default"
+	}
+	fmt.Fprintf(w, "profile: %s", profile)
+	if len(p.user.Profiles) > 0 {
+		fmt.Fprintf(w, " (profiles: %s)", strings.Join(slices.Sorted(maps.Keys(p.user.Profiles)), ", "))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "principals:")
+	for i, principal := range p.spec.Principals {
+		mark := " "
+		if p.selected[i] {
+			mark = "x"
+		}
+		fmt.Fprintf(w, "  %2d [%s] %s\n", i+1, mark, principal)
+	}
+	fmt.Fprintf(w, "validity: %d minutes (maximum %d)\n", p.validity, p.spec.Validity)
+}
+
+// command runs a menu command, writing any help to w and reporting if
+// the certificate should be issued
+func (p *picker) command(w io.Writer, line string) (bool, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return true, nil
+	}
+	if n, err := strconv.Atoi(args[0]); err == nil && len(args) == 1 {
+		if n < 1 || n > len(p.selected) {
+			return false, fmt.Errorf("no principal %d", n)
+		}
+		p.selected[n-1] = !p.selected[n-1]
+		return false, nil
+	}
+	switch args[0] {
+	case "issue":
+		return true, nil
+	case "quit", "exit":
+		return false, errPickCancelled
+	case "all", "none":
+		for i := range p.selected {
+			p.selected[i] = args[0] == "all"
+		}
+		return false, nil
+	case "validity":
+		if len(args) != 2 {
+			return false, errors.New("usage: validity <minutes>")
+		}
+		validity, err := util.ParseValidity(args[1])
+		if err != nil {
+			return false, err
+		}
+		if validity > p.spec.Validity {
+			return false, fmt.Errorf("validity %d minutes exceeds the maximum of %d", validity, p.spec.Validity)
+		}
+		p.validity = validity
+		return false, nil
+	case "profile":
+		if len(args) > 2 {
+			return false, errors.New("usage: profile [name]")
+		}
+		profile := ""
+		if len(args) == 2 && args[1] != "default" {
+			profile = args[1]
+		}
+		if _, ok := p.user.Profiles[profile]; profile != "" && !ok {
+			return false, fmt.Errorf("no profile %s", profile)
+		}
+		spec, err := p.settings.CertSpec(p.user, profile)
+		if err != nil {
+			return false, err
+		}
+		p.setSpec(spec)
+		return false, nil
+	case "help":
+		fmt.Fprintln(w, pickerHelp)
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown command %s, enter help for help", args[0])
+}
+
+// result is the certificate spec chosen
+func (p *picker) result() (*util.CertSpec, error) {
+	var principals []string
+	for i, principal := range p.spec.Principals {
+		if p.selected[i] {
+			principals = append(principals, principal)
+		}
+	}
+	if len(principals) == 0 {
+		return nil, errPickNone
+	}
+	return p.settings.Restrict(p.spec, principals, p.validity)
+}
+
+// pick runs the menu on the terminal until the user issues or cancels
+// their certificate request, returning the spec they chose
+func pick(t *term.Terminal, sshConn *ssh.ServerConn, p *picker) (*util.CertSpec, error) {
+	timer := time.AfterFunc(pickTimeout, func() { sshConn.Close() })
+	defer timer.Stop()
+	defer t.SetPrompt("")
+
+	t.SetPrompt("pick> ")
+	termWriter(t, pickerHelp)
+	for {
+		p.show(t)
+		line, err := t.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		issue, err := p.command(t, line)
+		if err != nil {
+			if errors.Is(err, errPickCancelled) {
+				return nil, err
+			}
+			termWriter(t, err.Error())
+			continue
+		}
+		if !issue {
+			continue
+		}
+		spec, err := p.result()
+		if err == nil {
+			return spec, nil
+		}
+		termWriter(t, err.Error())
+	}
+}
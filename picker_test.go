@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rorycl/sshagentca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestPicker(t *testing.T) {
+	settings, err := util.SettingsLoad("util/testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := settings.Users[0]
+	spec, err := settings.CertSpec(user, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		commands   []string
+		principals []string
+		profile    string
+		validity   uint32
+		err        string
+	}{
+		{name: "everything", commands: []string{""},
+			principals: []string{"alice", "team-web", "team-dba"}, validity: 60},
+		{name: "toggle", commands: []string{"1", "3", "3", "validity 15m", "issue"},
+			principals: []string{"team-web", "team-dba"}, validity: 15},
+		{name: "none then one", commands: []string{"none", "2", ""},
+			principals: []string{"team-web"}, validity: 60},
+		{name: "profile", commands: []string{"profile admin", "2", ""},
+			principals: []string{"alice-admin"}, profile: "admin", validity: 60},
+		{name: "no principal", commands: []string{"9"}, err: "no principal 9"},
+		{name: "validity too long", commands: []string{"validity 2h"}, err: "validity 120 minutes exceeds the maximum of 60"},
+		{name: "unknown profile", commands: []string{"profile prod"}, err: "no profile prod"},
+		{name: "unknown command", commands: []string{"nope"}, err: "unknown command nope"},
+		{name: "quit", commands: []string{"quit"}, err: errPickCancelled.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPicker(&settings, user, spec, spec)
+			var issue bool
+			var err error
+			for _, c := range tt.commands {
+				if issue, err = p.command(io.Discard, c); err != nil {
+					break
+				}
+			}
+			if tt.err != "" {
+				if !util.ErrorContains(err, tt.err) {
+					t.Errorf("got error %v want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !issue {
+				t.Fatal("commands did not issue")
+			}
+			got, err := p.result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.Principals, tt.principals) || got.Profile != tt.profile || got.Validity != tt.validity {
+				t.Errorf("got %q %v %d want %q %v %d", got.Profile, got.Principals, got.Validity,
+					tt.profile, tt.principals, tt.validity)
+			}
+		})
+	}
+
+	p := newPicker(&settings, user, spec, spec)
+	_, _ = p.command(io.Discard, "none")
+	if _, err := p.result(); err != errPickNone {
+		t.Errorf("got error %v with no principals", err)
+	}
+	var out bytes.Buffer
+	p.show(&out)
+	if !strings.Contains(out.String(), "   1 [ ] alice") || !strings.Contains(out.String(), "profiles: admin") {
+		t.Errorf("unexpected menu %q", out.String())
+	}
+}
+
+// testPickerSession forwards an agent, requests a pty and starts a shell,
+// giving the menu input
+func testPickerSession(client *ssh.Client, input string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return "", err
+	}
+	if err := session.RequestPty("xterm", 40, 80, ssh.TerminalModes{}); err != nil {
+		return "", err
+	}
+	if err := session.Shell(); err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(stdin, input); err != nil {
+		return "", err
+	}
+	output, _ := io.ReadAll(stdout)
+	return string(output), nil
+}
+
+// users of pty sessions choose their certificate from a menu, while
+// other sessions are issued their full entitlement
+func TestServePicker(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey)+"            - db\n")
+	ts := startTestServer(t, Options{}, settings)
+
+	tests := []struct {
+		name       string
+		input      string
+		principals []string
+		validity   uint64
+	}{
+		{name: "toggle", input: "1\nvalidity 10\n\n", principals: []string{"db"}, validity: 10},
+		{name: "retry", input: "none\n\n2\nissue\n", principals: []string{"db"}, validity: 30},
+		{name: "quit", input: "quit\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, keyring, err := testClientConn(ts.addr, "tester", userKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			output, err := testPickerSession(client, tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs := testAgentCerts(t, keyring)
+			if tt.principals == nil {
+				if len(certs) != 0 || !strings.Contains(output, errPickCancelled.Error()) {
+					t.Errorf("got %d certificates and output %q", len(certs), output)
+				}
+				return
+			}
+			if len(certs) != 1 {
+				t.Fatalf("expected one certificate, got %d: %q", len(certs), output)
+			}
+			if !slices.Equal(certs[0].ValidPrincipals, tt.principals) {
+				t.Errorf("got principals %v want %v", certs[0].ValidPrincipals, tt.principals)
+			}
+			if got := certs[0].ValidBefore - certs[0].ValidAfter; got != tt.validity*60 {
+				t.Errorf("got validity %d want %d", got, tt.validity*60)
+			}
+		})
+	}
+
+	client, keyring, err := testClientConn(ts.addr, "tester", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := testAgentSession(client); err != nil {
+		t.Fatal(err)
+	}
+	certs := testAgentCerts(t, keyring)
+	if len(certs) != 1 || len(certs[0].ValidPrincipals) != 2 {
+		t.Errorf("session without a pty was not issued its entitlement: %v", certs)
+	}
+}
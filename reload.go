@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rorycl/sshagentca/util"
+)
+
+// liveSettings holds the settings in use by the server, which may be
+// replaced by reloading the settings yaml file while the server is
+// running. Each connection takes a snapshot of the settings with Load
+// so that a reload does not change the settings used part way through
+// issuing a certificate.
+type liveSettings struct {
+	path    string
+	mu      sync.Mutex // serialises reloads
+	current atomic.Pointer[util.Settings]
+}
+
+// newLiveSettings makes a liveSettings from settings loaded from path
+func newLiveSettings(path string, settings util.Settings) *liveSettings {
+	l := &liveSettings{path: path}
+	l.current.Store(&settings)
+	return l
+}
+
+// Load returns the current settings
+func (l *liveSettings) Load() *util.Settings {
+	return l.current.Load()
+}
+
+// Reload loads and validates the settings file, replacing the current
+// settings only if the new settings are valid
+func (l *liveSettings) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	settings, err := util.SettingsLoad(l.path)
+	if err != nil {
+		log.Printf("settings reload failed, keeping existing settings: %s", err)
+		return err
+	}
+	old := l.current.Swap(&settings)
+
+	changes := util.SettingsChanges(old, &settings)
+	if len(changes) == 0 {
+		log.Printf("settings reloaded from %s: no changes", l.path)
+	}
+	for _, c := range changes {
+		log.Printf("settings reloaded from %s: %s", l.path, c)
+	}
+	return nil
+}
+
+// modTime returns the latest modification time of the files from which
+// the current settings were loaded, or the zero time if any of them
+// cannot be read
+func (l *liveSettings) modTime() time.Time {
+	sources := l.Load().Sources()
+	if len(sources) == 0 {
+		sources = []string{l.path}
+	}
+	var latest time.Time
+	for _, path := range sources {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// watchReload reloads the settings on SIGHUP and, if interval is more
+// than zero, when the modification time of the settings file or the
+// users directory and its files changes. It runs until ctx is done.
+func watchReload(ctx context.Context, settings *liveSettings, interval time.Duration) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	var modTime time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		modTime = settings.modTime()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("SIGHUP received, reloading settings")
+			_ = settings.Reload()
+		case <-tick:
+			latest := settings.modTime()
+			if latest.IsZero() || latest.Equal(modTime) {
+				continue
+			}
+			modTime = latest
+			log.Printf("settings file changed, reloading settings")
+			_ = settings.Reload()
+		}
+	}
+}
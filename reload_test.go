@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/sshagentca/util"
+)
+
+// reloading should let a newly added user connect and keep the
+// existing settings if the new settings are invalid
+func TestReload(t *testing.T) {
+	userKey := newTestSigner(t)
+	newUserKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{}, settings)
+
+	if _, _, err := testClientSession(ts.addr, newUserKey); err == nil {
+		t.Fatal("unregistered user was able to connect")
+	}
+
+	err := os.WriteFile(settings.path, []byte(testUserYaml(newUserKey)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Reload(); err != nil {
+		t.Fatalf("reload failed: %s", err)
+	}
+	_, output, err := testClientSession(ts.addr, newUserKey)
+	if err != nil {
+		t.Fatalf("new user could not connect after reload: %s", err)
+	}
+	if !strings.Contains(output, "certificate generation complete") {
+		t.Errorf("unexpected output %q", output)
+	}
+	if _, _, err := testClientSession(ts.addr, userKey); err == nil {
+		t.Error("removed user was able to connect after reload")
+	}
+
+	// invalid settings are not applied
+	err = os.WriteFile(settings.path, []byte("validity: 0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Reload(); err == nil {
+		t.Fatal("invalid settings reloaded without error")
+	}
+	if _, _, err := testClientSession(ts.addr, newUserKey); err != nil {
+		t.Errorf("existing settings not kept after failed reload: %s", err)
+	}
+}
+
+// changes to files in the users directory are noticed by the reload
+// poller
+func TestReloadUsersDirModTime(t *testing.T) {
+	userKey := newTestSigner(t)
+	dir := t.TempDir()
+	usersDir := filepath.Join(dir, "users.d")
+	if err := os.Mkdir(usersDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	usersFile := filepath.Join(usersDir, "team.yaml")
+	users := testUserYaml(userKey)
+	users = users[strings.Index(users, "user_principals:"):]
+	if err := os.WriteFile(usersFile, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "settings.yaml")
+	if err := os.WriteFile(path, []byte("validity: 30\norganisation: testorg\nusers_dir: users.d\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := util.SettingsLoad(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := newLiveSettings(path, loaded)
+
+	before := settings.modTime()
+	if before.IsZero() {
+		t.Fatal("no modification time for settings")
+	}
+	later := before.Add(time.Minute)
+	if err := os.Chtimes(usersFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := settings.modTime(); !got.Equal(later) {
+		t.Errorf("users file change not noticed: got %s want %s", got, later)
+	}
+}
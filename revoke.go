@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/sshagentca/util"
+)
+
+const revokeUsage = `revoke <options>
+
+Revoke certificates issued by sshagentca by serial number, key id or
+the fingerprint of the user key used to obtain them, then regenerate
+the OpenSSH key revocation list (KRL) for use with the sshd RevokedKeys
+setting. Revoking a fingerprint revokes all the certificates recorded
+in the ledger for that key; remove the key from the settings file to
+stop further certificates being issued.
+
+Run without serials, key ids or fingerprints to regenerate the KRL only.
+
+Application Arguments:
+
+ `
+
+// RevokeOptions are the command line options for the revoke subcommand
+type RevokeOptions struct {
+	CAPublicKey     string   `short:"a" long:"caPublicKey" required:"true" description:"certificate authority public key file"`
+	LedgerFile      string   `short:"l" long:"ledgerFile" default:"sshagentca.ledger" description:"certificate ledger file"`
+	RevocationsFile string   `short:"r" long:"revocationsFile" default:"sshagentca.revoked" description:"file recording revocations"`
+	KRLFile         string   `short:"k" long:"krlFile" default:"sshagentca.krl" description:"key revocation list file to write"`
+	Serials         []uint64 `short:"s" long:"serial" description:"revoke the certificate with this serial number (may be repeated)"`
+	KeyIDs          []string `short:"I" long:"keyid" description:"revoke certificates with this key id (may be repeated)"`
+	Fingerprints    []string `short:"f" long:"fingerprint" description:"revoke certificates issued to this user key fingerprint (may be repeated)"`
+	Reason          string   `long:"reason" description:"reason for revocation"`
+}
+
+// revokeCommand records revocations and regenerates the krl
+func revokeCommand(args []string) error {
+
+	var options RevokeOptions
+	var parser = flags.NewParser(&options, flags.Default)
+	parser.Usage = revokeUsage
+	if _, err := parser.ParseArgs(args); err != nil {
+		return err
+	}
+
+	caKey, err := util.LoadPublicKey(options.CAPublicKey)
+	if err != nil {
+		return fmt.Errorf("could not load ca public key: %w", err)
+	}
+
+	entries, err := util.ReadLedger(options.LedgerFile)
+	if err != nil {
+		return err
+	}
+
+	// check each revocation matches an issued certificate
+	now := time.Now().UTC()
+	revocations := []util.Revocation{}
+	for _, s := range options.Serials {
+		if !slices.ContainsFunc(entries, func(e util.LedgerEntry) bool { return e.Serial == s }) {
+			return fmt.Errorf("serial %d not found in ledger", s)
+		}
+		revocations = append(revocations, util.Revocation{Time: now, Serial: s, Reason: options.Reason})
+	}
+	for _, id := range options.KeyIDs {
+		if !slices.ContainsFunc(entries, func(e util.LedgerEntry) bool { return e.KeyID == id }) {
+			return fmt.Errorf("key id %s not found in ledger", id)
+		}
+		revocations = append(revocations, util.Revocation{Time: now, KeyID: id, Reason: options.Reason})
+	}
+	for _, fp := range options.Fingerprints {
+		if !slices.ContainsFunc(entries, func(e util.LedgerEntry) bool { return e.Fingerprint == fp }) {
+			return fmt.Errorf("fingerprint %s not found in ledger", fp)
+		}
+		revocations = append(revocations, util.Revocation{Time: now, Fingerprint: fp, Reason: options.Reason})
+	}
+	for _, r := range revocations {
+		if err := util.RecordRevocation(options.RevocationsFile, r); err != nil {
+			return fmt.Errorf("could not record revocation: %w", err)
+		}
+	}
+
+	all, err := util.ReadRevocations(options.RevocationsFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	krl := util.BuildKRL(caKey, entries, all)
+	krl.Comment = fmt.Sprintf("sshagentca krl generated %s", krl.Generated.Format(time.RFC3339))
+	if err := krl.WriteFile(options.KRLFile); err != nil {
+		return err
+	}
+	fmt.Printf("recorded %d revocations; wrote %s revoking %d serials and %d key ids\n",
+		len(revocations), options.KRLFile, len(krl.Serials), len(krl.KeyIDs))
+	return nil
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rorycl/sshagentca/util"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/term"
 )
 
@@ -22,76 +24,214 @@ import (
 // https://godoc.org/golang.org/x/crypto/ssh#ServerConn and the Scalingo
 // blog posting at
 // https://scalingo.com/blog/writing-a-replacement-to-openssh-using-go-22.html
-func Serve(options Options, privateKey ssh.Signer, caKey ssh.Signer, settings util.Settings) {
+func Serve(ctx context.Context, options Options, privateKey ssh.Signer, issuer *certIssuer, settings *liveSettings) error {
 
-	// configure server
+	sshConfig := newServerConfig(privateKey, settings)
+
+	// setup net listener
+	log.Printf("\n\nStarting server connection for %s...", settings.Load().Organisation)
+	addrPort := strings.Join([]string{options.IPAddress, options.Port}, ":")
+	listener, err := net.Listen("tcp", addrPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addrPort, err)
+	}
+	log.Printf("Listening on %s", addrPort)
+
+	return serveListener(ctx, listener, sshConfig, options, issuer, settings)
+}
+
+// newServerConfig configures the ssh server to only accept public keys
+// registered in the current settings. Keys are rejected if the user's
+// account is not currently valid or the login username names a profile
+// the key's user is not entitled to. If the settings require TOTP
+// codes, a key only partially authenticates the user, who must then
+// give a current code by keyboard-interactive authentication.
+func newServerConfig(privateKey ssh.Signer, settings *liveSettings) *ssh.ServerConfig {
+	replay := newTOTPReplay()
+	failures := newTOTPFailures()
 	sshConfig := &ssh.ServerConfig{
 		// public key callback taken directly from ssh.ServerConn example
 		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			_, err := settings.UserByFingerprint(ssh.FingerprintSHA256(pubKey))
-			if err == nil {
-				return &ssh.Permissions{
-					Extensions: map[string]string{
-						"pubkey-fp": ssh.FingerprintSHA256(pubKey),
-					},
-				}, nil
+			s := settings.Load()
+			fp := ssh.FingerprintSHA256(pubKey)
+			user, err := s.UserByFingerprint(fp)
+			if err != nil {
+				return nil, fmt.Errorf("unknown public key for %q", c.User())
 			}
-			return nil, fmt.Errorf("unknown public key for %q", c.User())
+			if err := user.ActiveAt(time.Now()); err != nil {
+				log.Printf("rejected key %s: %s", user.Key(fp), err)
+				return nil, err
+			}
+			if _, err := s.SelectProfile(user, c.User()); err != nil {
+				log.Printf("rejected key %s: %s", user.Key(fp), err)
+				return nil, err
+			}
+			perms := &ssh.Permissions{
+				Extensions: map[string]string{
+					"pubkey-fp": fp,
+				},
+			}
+			if s.TOTPRequired() {
+				return nil, &ssh.PartialSuccessError{Next: totpCallbacks(s, user, user.Key(fp), replay, failures, perms)}
+			}
+			return perms, nil
 		},
 	}
 	sshConfig.AddHostKey(privateKey)
+	return sshConfig
+}
 
-	// setup net listener
-	log.Printf("\n\nStarting server connection for %s...", settings.Organisation)
-	addrPort := strings.Join([]string{options.IPAddress, options.Port}, ":")
-	listener, err := net.Listen("tcp", addrPort)
-	if err != nil {
-		log.Fatalf("Failed to listen on %s", addrPort)
-	} else {
-		log.Printf("Listening on %s", addrPort)
-	}
+// serveListener accepts connections on listener until ctx is done,
+// handling each connection in its own goroutine so that a slow client
+// cannot hold up others. At most options.MaxConns connections are
+// serviced concurrently; further connections wait in the listen
+// backlog until a slot is free.
+// On shutdown the listener is closed and connections in flight are
+// given options.ShutdownTimeout to finish issuing certificates.
+func serveListener(ctx context.Context, listener net.Listener, sshConfig *ssh.ServerConfig, options Options, issuer *certIssuer, settings *liveSettings) error {
+
+	slots := make(chan struct{}, options.MaxConns)
+	var inFlight sync.WaitGroup
+
+	// stop accepting on shutdown
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stopped:
+		}
+	}()
 
 	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return drain(&inFlight, options.ShutdownTimeout)
+		}
+
 		// make tcp connection
 		tcpConn, err := listener.Accept()
 		if err != nil {
+			<-slots
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return drain(&inFlight, options.ShutdownTimeout)
+			}
 			log.Printf("failed to accept incoming connection (%s)", err)
 			continue
 		}
 
-		// provide handshake
-		sshConn, chans, _, err := ssh.NewServerConn(tcpConn, sshConfig)
-		if err != nil {
-			log.Printf("failed to handshake (%s)", err)
-			continue
-		}
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			handleConn(ctx, tcpConn, sshConfig, options, issuer, settings)
+		}()
+	}
+}
 
-		// extract user
-		user, err := settings.UserByFingerprint(sshConn.Permissions.Extensions["pubkey-fp"])
-		if err != nil {
-			log.Printf("verification error from unknown user %s", sshConn.Permissions.Extensions["pubkey-fp"])
-			continue
-		}
+// drain waits up to timeout for in flight connections to complete
+func drain(inFlight *sync.WaitGroup, timeout time.Duration) error {
+	log.Println("no longer accepting connections, waiting for connections in flight")
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("all connections completed")
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("connections still in flight after %s", timeout)
+	}
+}
 
-		// report remote address, user and key
-		log.Printf("new ssh connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
-		log.Printf("user %s logged in with key %s", user.Name, user.Fingerprint)
+// handleConn performs the ssh handshake for a single client connection
+// and services the client's session channels. The handshake must
+// complete within options.HandshakeTimeout, and the client must then
+// start a session within the same time again, so that idle clients do
+// not hold connection slots. The connection uses a snapshot of the
+// settings taken after the handshake, which is unaffected by later
+// reloads. If ctx is cancelled, connections waiting for input from their
+// user are closed, while certificates being issued are completed.
+func handleConn(ctx context.Context, tcpConn net.Conn, sshConfig *ssh.ServerConfig, options Options, issuer *certIssuer, live *liveSettings) {
 
-		// https://lists.gt.net/openssh/dev/72190
-		agentChan, reqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
-		if err != nil {
-			log.Printf("Could not open agent channel %s", err)
+	// provide handshake
+	_ = tcpConn.SetDeadline(time.Now().Add(options.HandshakeTimeout))
+	sshConn, chans, globalReqs, err := ssh.NewServerConn(tcpConn, sshConfig)
+	if err != nil {
+		log.Printf("failed to handshake with %s (%s)", tcpConn.RemoteAddr(), err)
+		tcpConn.Close()
+		return
+	}
+	// allow for the wait for a shell or exec request by clients which
+	// only forward an agent
+	_ = tcpConn.SetDeadline(time.Now().Add(options.HandshakeTimeout + agentOnlyWait))
+	started := func() { _ = tcpConn.SetDeadline(time.Time{}) }
+	go ssh.DiscardRequests(globalReqs)
+	settings := live.Load()
+
+	// extract user and the key they used
+	fp := sshConn.Permissions.Extensions["pubkey-fp"]
+	user, err := settings.UserByFingerprint(fp)
+	if err != nil {
+		log.Printf("verification error from unknown user %s", fp)
+		sshConn.Close()
+		return
+	}
+	key := user.Key(fp)
+
+	// report remote address, user and key
+	log.Printf("new ssh connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+	log.Printf("user %s logged in with key %s", user.Name, key)
+
+	// approvers connect with the approve username to decide requests
+	if settings.ApprovalRequired() && sshConn.User() == util.ApproveUsername {
+		if !settings.IsApprover(user) {
+			log.Printf("user %s is not an approver", user.Name)
 			sshConn.Close()
-			continue
+			return
 		}
-		agentConn := agent.NewClient(agentChan)
-
-		// discard incoming out-of-band requests
-		go ssh.DiscardRequests(reqs)
+		log.Printf("user %s connected as approver", user.Name)
+		handleApprover(ctx, chans, sshConn, started, user, settings, issuer.approvals)
+		return
+	}
 
-		// accept all channels
-		go handleChannels(chans, user, settings, sshConn, agentConn, caKey)
+	// determine the certificate to issue from the profile selected by
+	// the login username
+	profile, err := settings.SelectProfile(user, sshConn.User())
+	if err != nil {
+		log.Print(err)
+		sshConn.Close()
+		return
 	}
+	spec, err := settings.CertSpec(user, profile)
+	if err != nil {
+		log.Print(err)
+		sshConn.Close()
+		return
+	}
+	if profile != "" {
+		log.Printf("user %s selected profile %s", user.Name, profile)
+	}
+
+	req := &certRequest{user: user, key: key, spec: spec, settings: settings, conn: sshConn}
+
+	// accept all channels
+	handleChannels(ctx, chans, req, sshConn, started, issuer)
+}
+
+// closeOnShutdown closes the client connection if ctx is cancelled,
+// as the server shuts down, before the returned stop function is
+// called. It is used while waiting for input from users, which may take
+// longer than the shutdown timeout.
+func closeOnShutdown(ctx context.Context, sshConn *ssh.ServerConn, user string) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		log.Printf("closing connection of user %s waiting for input on shutdown", user)
+		sshConn.Close()
+	})
 }
 
 // write to the connection terminal, ignoring errors
@@ -114,11 +254,44 @@ func chanCloser(c ssh.Channel, isError bool) {
 	}
 }
 
-// Service the incoming channel. The certErr channel indicates when the
-// certificate has finished generation
-func handleChannels(chans <-chan ssh.NewChannel, user *util.UserPrincipals,
-	settings util.Settings, sshConn *ssh.ServerConn, agentConn agent.ExtendedAgent,
-	caKey ssh.Signer) {
+// reasonAttempts is the number of times a user is asked for a reason,
+// and reasonTimeout the time they have to give one before the
+// connection is closed
+const (
+	reasonAttempts = 3
+	reasonTimeout  = 2 * time.Minute
+)
+
+// readReason asks the user for the reason they need a certificate
+// until they give a reason permitted by the settings
+func readReason(t *term.Terminal, sshConn *ssh.ServerConn, settings *util.Settings) (string, error) {
+	timer := time.AfterFunc(reasonTimeout, func() { sshConn.Close() })
+	defer timer.Stop()
+	defer t.SetPrompt("")
+
+	t.SetPrompt("reason: ")
+	termWriter(t, "this profile requires a reason, such as a ticket number")
+	var err error
+	for range reasonAttempts {
+		var line, reason string
+		line, err = t.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		reason, err = settings.CheckReason(line)
+		if err == nil {
+			return reason, nil
+		}
+		termWriter(t, err.Error())
+	}
+	return "", err
+}
+
+// Service the incoming channel, running the command requested by the
+// client for the certificate request certReq. started is called once
+// the session has been set up.
+func handleChannels(ctx context.Context, chans <-chan ssh.NewChannel, certReq *certRequest, sshConn *ssh.ServerConn,
+	started func(), issuer *certIssuer) {
 
 	defer sshConn.Close()
 
@@ -136,36 +309,28 @@ func handleChannels(chans <-chan ssh.NewChannel, user *util.UserPrincipals,
 		}
 		defer ch.Close()
 
-		// only respond to "exec" type requests
-		req := <-reqs
-		if req.Type != "auth-agent-req@openssh.com" {
+		// read the agent forwarding, pty and environment requests
+		// setting up the session until it starts
+		setup, err := readSession(reqs)
+		if errors.Is(err, errRequestNotSupported) {
 			_, err = ch.Write([]byte("request type not supported\n"))
 			if err != nil {
 				log.Printf("channel write error for invalid request type %v", err)
 			}
 			return
 		}
-
-		// terminal
-		term := term.NewTerminal(ch, "")
-		termWriter(term, settings.Banner)
-		termWriter(term, fmt.Sprintf("welcome, %s", user.Name))
-
-		// add certificate to agent, let the user know, then close the
-		// connection
-		err = addCertToAgent(agentConn, caKey, user, settings)
 		if err != nil {
-			log.Printf("certificate creation error %s\n", err)
-			termWriter(term, "certificate creation error")
-			termWriter(term, "goodbye\n")
-			chanCloser(ch, true)
-		} else {
-			log.Printf("certificate creation and insertion in agent done\n")
-			termWriter(term, "certificate generation complete")
-			termWriter(term, "run 'ssh-add -l' to view")
-			termWriter(term, "goodbye\n")
-			chanCloser(ch, false)
+			return
+		}
+		started()
+		go ssh.DiscardRequests(reqs)
+		if setup.exec {
+			log.Printf("user %s ran %q", certReq.user.Name, setup.command)
 		}
+
+		s := &session{ctx: ctx, ch: ch, sshConn: sshConn, issuer: issuer, certReq: certReq, setup: setup}
+		err = s.run()
+		chanCloser(ch, err != nil)
 		time.Sleep(500 * time.Millisecond)
 		log.Println("closing the connection")
 		sshConn.Close()
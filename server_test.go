@@ -0,0 +1,1196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/sshagentca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// settings yaml template for test servers; the user public key is
+// substituted at %s
+const testSettingsYaml = `
+validity: 30
+organisation: testorg
+banner: "test certificate service"
+extensions:
+    permit-pty: ""
+user_principals:
+    -
+        name: tester
+        sshpublickey: "%s"
+        principals:
+            - web
+`
+
+// newTestSigner makes a new ed25519 ssh signer
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, pvt, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(pvt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeTestSettings writes yaml to a temporary settings file and loads it
+func writeTestSettings(t *testing.T, yaml string) *liveSettings {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "settings.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := util.SettingsLoad(path)
+	if err != nil {
+		t.Fatalf("could not load test settings: %s", err)
+	}
+	return newLiveSettings(path, settings)
+}
+
+// testUserYaml returns the default test settings for userKey
+func testUserYaml(userKey ssh.Signer) string {
+	pub := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(userKey.PublicKey())))
+	return fmt.Sprintf(testSettingsYaml, pub)
+}
+
+// testServer is a server running on a loopback listener
+type testServer struct {
+	addr       string
+	issuer     *certIssuer
+	ledgerPath string
+	cancel     context.CancelFunc
+	done       chan error
+}
+
+// startTestServer runs a server on a loopback listener. The server is
+// shut down at the end of the test.
+func startTestServer(t *testing.T, options Options, settings *liveSettings) *testServer {
+	t.Helper()
+	if options.HandshakeTimeout == 0 {
+		options.HandshakeTimeout = 5 * time.Second
+	}
+	if options.MaxConns == 0 {
+		options.MaxConns = 4
+	}
+	if options.ShutdownTimeout == 0 {
+		options.ShutdownTimeout = 5 * time.Second
+	}
+	serials, err := util.NewSerialAllocator(filepath.Join(t.TempDir(), "serial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledgerPath := filepath.Join(t.TempDir(), "ledger")
+	ledger, err := util.OpenLedger(ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	issuer := &certIssuer{caKey: newTestSigner(t), serials: serials, ledger: ledger, approvals: newApprovals()}
+	sshConfig := newServerConfig(newTestSigner(t), settings)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := &testServer{
+		addr:       listener.Addr().String(),
+		issuer:     issuer,
+		ledgerPath: ledgerPath,
+		cancel:     cancel,
+		done:       make(chan error, 1),
+	}
+	go func() {
+		ts.done <- serveListener(ctx, listener, sshConfig, options, issuer, settings)
+	}()
+	t.Cleanup(cancel)
+	return ts
+}
+
+// testClientConn connects to addr as user with userKey and any further
+// auth methods, serving a forwarded in-memory agent
+func testClientConn(addr, user string, userKey ssh.Signer, auth ...ssh.AuthMethod) (*ssh.Client, agent.Agent, error) {
+	keyring := agent.NewKeyring()
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            append([]ssh.AuthMethod{ssh.PublicKeys(userKey)}, auth...),
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	tcpConn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, keyring, err
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(tcpConn, addr, config)
+	if err != nil {
+		return nil, keyring, err
+	}
+
+	// the server opens the agent channel when it issues a certificate,
+	// so serve it apart from the channels handed to the client
+	otherChans := make(chan ssh.NewChannel)
+	go func() {
+		defer close(otherChans)
+		for ch := range chans {
+			if ch.ChannelType() == "auth-agent@openssh.com" {
+				agentChan, agentReqs, err := ch.Accept()
+				if err != nil {
+					continue
+				}
+				go ssh.DiscardRequests(agentReqs)
+				go func() {
+					_ = agent.ServeAgent(keyring, agentChan)
+					agentChan.Close()
+				}()
+				continue
+			}
+			otherChans <- ch
+		}
+	}()
+	return ssh.NewClient(conn, otherChans, reqs), keyring, nil
+}
+
+// testAgentSession runs an agent forwarding session on client,
+// returning the session output
+func testAgentSession(client *ssh.Client) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return "", err
+	}
+	output, _ := io.ReadAll(stdout)
+	return string(output), nil
+}
+
+// testClientSession connects to addr with userKey and a forwarded
+// in-memory agent, returning the agent and the session output
+func testClientSession(addr string, userKey ssh.Signer) (agent.Agent, string, error) {
+	client, keyring, err := testClientConn(addr, "tester", userKey)
+	if err != nil {
+		return keyring, "", err
+	}
+	defer client.Close()
+	output, err := testAgentSession(client)
+	return keyring, output, err
+}
+
+// a hung tcp client that never sends an ssh version string should not
+// prevent another client from receiving a certificate
+func TestServeHungClient(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{HandshakeTimeout: time.Minute}, settings)
+
+	hung, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hung.Close()
+
+	type result struct {
+		keyring agent.Agent
+		output  string
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		keyring, output, err := testClientSession(ts.addr, userKey)
+		done <- result{keyring, output, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("client session failed: %s", r.err)
+		}
+		if !strings.Contains(r.output, "certificate generation complete") {
+			t.Errorf("unexpected output %q", r.output)
+		}
+		keys, err := r.keyring.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || !strings.Contains(keys[0].Format, "cert") {
+			t.Errorf("expected one certificate in agent, got %v", keys)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("client was starved by hung connection")
+	}
+}
+
+// a client that does not complete the handshake within the handshake
+// timeout should be disconnected
+func TestServeHandshakeTimeout(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{HandshakeTimeout: 200 * time.Millisecond}, settings)
+
+	hung, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hung.Close()
+
+	_ = hung.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(hung)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("hung connection was not closed by the server")
+	}
+}
+
+// the connection limit should hold further clients until a slot is free
+func TestServeMaxConns(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{HandshakeTimeout: 500 * time.Millisecond, MaxConns: 1}, settings)
+
+	hung, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hung.Close()
+
+	// the session can only proceed once the hung client times out
+	start := time.Now()
+	_, output, err := testClientSession(ts.addr, userKey)
+	if err != nil {
+		t.Fatalf("client session failed: %s", err)
+	}
+	if !strings.Contains(output, "certificate generation complete") {
+		t.Errorf("unexpected output %q", output)
+	}
+	if time.Since(start) < 400*time.Millisecond {
+		t.Errorf("connection limit was not applied")
+	}
+}
+
+// an authenticated client which does not open a session, or does not
+// start the session it opens, should be disconnected after the
+// handshake timeout so that it gives up its connection slot
+func TestServeIdleClient(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{HandshakeTimeout: 500 * time.Millisecond, MaxConns: 1}, settings)
+
+	for _, openSession := range []bool{false, true} {
+		idle, _, err := testClientConn(ts.addr, "tester", userKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idle.Close()
+		if openSession {
+			session, err := idle.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			_ = idle.Wait()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("idle client (session %t) was not disconnected", openSession)
+		}
+
+		_, output, err := testClientSession(ts.addr, userKey)
+		if err != nil {
+			t.Fatalf("client session failed: %s", err)
+		}
+		if !strings.Contains(output, "certificate generation complete") {
+			t.Errorf("unexpected output %q", output)
+		}
+	}
+}
+
+// shutting down should stop new connections but let a connected client
+// finish receiving its certificate
+func TestServeShutdown(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{}, settings)
+
+	client, keyring, err := testClientConn(ts.addr, "tester", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ts.cancel()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := net.Dial("tcp", ts.addr); err == nil {
+		t.Error("server accepted a connection after shutdown")
+	}
+
+	output, err := testAgentSession(client)
+	if err != nil {
+		t.Fatalf("in flight session failed: %s", err)
+	}
+	if !strings.Contains(output, "certificate generation complete") {
+		t.Errorf("unexpected output %q", output)
+	}
+	keys, _ := keyring.List()
+	if len(keys) != 1 {
+		t.Errorf("expected one certificate in agent, got %d keys", len(keys))
+	}
+
+	select {
+	case err := <-ts.done:
+		if err != nil {
+			t.Errorf("unexpected shutdown error %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+}
+
+// a connection that does not finish should not hold up shutdown beyond
+// the shutdown timeout
+func TestServeShutdownTimeout(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{ShutdownTimeout: 200 * time.Millisecond}, settings)
+
+	client, _, err := testClientConn(ts.addr, "tester", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ts.cancel()
+	select {
+	case err := <-ts.done:
+		if !util.ErrorContains(err, "connections still in flight") {
+			t.Errorf("unexpected shutdown error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+}
+
+// shutting down should close connections waiting for input from their
+// users, such as the certificate menu and approver sessions, rather
+// than waiting for the shutdown timeout
+func TestServeShutdownWaiting(t *testing.T) {
+	userKey := newTestSigner(t)
+	yaml := testUserYaml(userKey) + "approval:\n    principals: [root]\n    approvers: [tester]\n"
+	settings := writeTestSettings(t, yaml)
+	ts := startTestServer(t, Options{ShutdownTimeout: time.Minute}, settings)
+
+	client, keyring, err := testClientConn(ts.addr, "tester", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	picked := make(chan string, 1)
+	go func() {
+		output, _ := testPickerSession(client, "")
+		picked <- output
+	}()
+
+	approver, _, err := testClientConn(ts.addr, util.ApproveUsername, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer approver.Close()
+	session, err := approver.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	approved := make(chan struct{})
+	go func() {
+		_, _ = io.ReadAll(stdout)
+		close(approved)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	ts.cancel()
+	select {
+	case err := <-ts.done:
+		if err != nil {
+			t.Errorf("unexpected shutdown error %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server waited for connections waiting for input")
+	}
+	select {
+	case <-approved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("approver session was not closed")
+	}
+	select {
+	case output := <-picked:
+		if !strings.Contains(output, "pick> ") {
+			t.Errorf("menu not shown: %q", output)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("menu session was not closed")
+	}
+	if certs := testAgentCerts(t, keyring); len(certs) != 0 {
+		t.Errorf("certificate issued on shutdown")
+	}
+}
+
+// testAgentCerts returns the certificates held in an agent
+func testAgentCerts(t *testing.T, a agent.Agent) []*ssh.Certificate {
+	t.Helper()
+	keys, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := []*ssh.Certificate{}
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// each certificate should have a new serial number
+func TestServeSerials(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{}, settings)
+
+	for want := uint64(1); want <= 2; want++ {
+		keyring, _, err := testClientSession(ts.addr, userKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs := testAgentCerts(t, keyring)
+		if len(certs) != 1 {
+			t.Fatalf("expected one certificate, got %d", len(certs))
+		}
+		if certs[0].Serial != want {
+			t.Errorf("got serial %d want %d", certs[0].Serial, want)
+		}
+		keys, _ := keyring.List()
+		if !strings.HasSuffix(keys[0].Comment, fmt.Sprintf("_serial:%d", want)) {
+			t.Errorf("serial not in agent comment %q", keys[0].Comment)
+		}
+	}
+}
+
+// each certificate issued should be recorded in the ledger
+func TestServeLedger(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{}, settings)
+
+	keyring, _, err := testClientSession(ts.addr, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := testAgentCerts(t, keyring)
+	if len(certs) != 1 {
+		t.Fatalf("expected one certificate, got %d", len(certs))
+	}
+
+	entries, err := util.ReadLedger(ts.ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one ledger entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Serial != certs[0].Serial || e.KeyID != certs[0].KeyId {
+		t.Errorf("ledger entry %d %s does not match certificate %d %s", e.Serial, e.KeyID, certs[0].Serial, certs[0].KeyId)
+	}
+	if e.User != "tester" || e.Fingerprint != ssh.FingerprintSHA256(userKey.PublicKey()) {
+		t.Errorf("unexpected ledger user %s %s", e.User, e.Fingerprint)
+	}
+	if !strings.HasPrefix(e.RemoteAddr, "127.0.0.1:") || !strings.HasPrefix(e.ClientVersion, "SSH-2.0-Go") {
+		t.Errorf("unexpected ledger client %s %s", e.RemoteAddr, e.ClientVersion)
+	}
+	if uint64(e.ValidBefore.Unix()) != certs[0].ValidBefore {
+		t.Errorf("ledger validity %s does not match certificate", e.ValidBefore)
+	}
+}
+
+// the login username selects a profile, which is refused to users
+// without that profile
+func TestServeProfiles(t *testing.T) {
+	userKey := newTestSigner(t)
+	otherKey := newTestSigner(t)
+	yaml := testUserYaml(userKey) + `        profiles:
+            prod:
+                principals:
+                    - root
+                validity: 5
+    -
+        name: other
+        sshpublickey: "` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(otherKey.PublicKey()))) + `"
+        principals:
+            - web
+`
+	settings := writeTestSettings(t, yaml)
+	ts := startTestServer(t, Options{}, settings)
+
+	client, keyring, err := testClientConn(ts.addr, "prod", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := testAgentSession(client); err != nil {
+		t.Fatal(err)
+	}
+	certs := testAgentCerts(t, keyring)
+	if len(certs) != 1 {
+		t.Fatalf("expected one certificate, got %d", len(certs))
+	}
+	if len(certs[0].ValidPrincipals) != 1 || certs[0].ValidPrincipals[0] != "root" {
+		t.Errorf("unexpected principals %v", certs[0].ValidPrincipals)
+	}
+	if certs[0].ValidBefore-certs[0].ValidAfter != 5*60 {
+		t.Errorf("unexpected validity %d", certs[0].ValidBefore-certs[0].ValidAfter)
+	}
+	if !strings.Contains(certs[0].KeyId, "_tester_prod_") {
+		t.Errorf("profile not in key id %s", certs[0].KeyId)
+	}
+
+	if _, _, err := testClientConn(ts.addr, "prod", otherKey); err == nil {
+		t.Error("user without profile was able to select it")
+	}
+	if _, _, err := testClientConn(ts.addr, "anything", otherKey); err != nil {
+		t.Errorf("user could not connect with an arbitrary username: %s", err)
+	}
+}
+
+// certificates can be bound to the client's network
+func TestServeBindSource(t *testing.T) {
+	userKey := newTestSigner(t)
+	yaml := testUserYaml(userKey) + `        bind_source_address:
+            ipv4_prefix: 24
+`
+	settings := writeTestSettings(t, yaml)
+	ts := startTestServer(t, Options{}, settings)
+
+	keyring, _, err := testClientSession(ts.addr, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := testAgentCerts(t, keyring)
+	if len(certs) != 1 {
+		t.Fatalf("expected one certificate, got %d", len(certs))
+	}
+	if got := certs[0].CriticalOptions["source-address"]; got != "127.0.0.0/24" {
+		t.Errorf("got source-address %q", got)
+	}
+}
+
+// each of a user's keys obtains a certificate, with the key label in
+// the key id and ledger
+func TestServeMultipleKeys(t *testing.T) {
+	laptopKey := newTestSigner(t)
+	tokenKey := newTestSigner(t)
+	authorized := func(k ssh.Signer) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.PublicKey())))
+	}
+	yaml := `
+validity: 30
+organisation: testorg
+banner: "test certificate service"
+user_principals:
+    -
+        name: tester
+        sshpublickeys:
+            - key: "` + authorized(laptopKey) + `"
+              label: laptop
+            - "` + authorized(tokenKey) + `"
+        principals:
+            - web
+`
+	settings := writeTestSettings(t, yaml)
+	ts := startTestServer(t, Options{}, settings)
+
+	for _, k := range []ssh.Signer{laptopKey, tokenKey} {
+		if _, _, err := testClientSession(ts.addr, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := util.ReadLedger(ts.ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected two ledger entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.User != "tester" || e.KeyLabel != "laptop" || !strings.HasPrefix(e.KeyID, "testorg_tester_laptop_from:") {
+		t.Errorf("unexpected labelled key entry %s %s %s", e.User, e.KeyLabel, e.KeyID)
+	}
+	if e := entries[1]; e.User != "tester" || e.KeyLabel != "" || !strings.HasPrefix(e.KeyID, "testorg_tester_from:") {
+		t.Errorf("unexpected unlabelled key entry %s %s %s", e.User, e.KeyLabel, e.KeyID)
+	}
+	if entries[1].Fingerprint != ssh.FingerprintSHA256(tokenKey.PublicKey()) {
+		t.Errorf("ledger fingerprint %s is not the key used", entries[1].Fingerprint)
+	}
+}
+
+// users outside their account dates are refused and certificates do
+// not outlive the account
+func TestServeAccountDates(t *testing.T) {
+	userKey := newTestSigner(t)
+	date := func(d time.Duration) string {
+		return time.Now().Add(d).UTC().Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name      string
+		dates     string
+		connects  bool
+		maxExpiry time.Duration
+	}{
+		{"expired", "        valid_until: " + date(-time.Hour) + "\n", false, 0},
+		{"not yet valid", "        valid_from: " + date(time.Hour) + "\n", false, 0},
+		{"expiring", "        valid_from: " + date(-time.Hour) + "\n        valid_until: " + date(10*time.Minute) + "\n", true, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := writeTestSettings(t, testUserYaml(userKey)+tt.dates)
+			ts := startTestServer(t, Options{}, settings)
+			keyring, _, err := testClientSession(ts.addr, userKey)
+			if !tt.connects {
+				if err == nil {
+					t.Error("user connected outside account dates")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			certs := testAgentCerts(t, keyring)
+			if len(certs) != 1 {
+				t.Fatalf("expected one certificate, got %d", len(certs))
+			}
+			expiry := time.Unix(int64(certs[0].ValidBefore), 0)
+			if expiry.After(time.Now().Add(tt.maxExpiry)) {
+				t.Errorf("certificate expiry %s not capped at account expiry", expiry)
+			}
+		})
+	}
+}
+
+// certificates are refused outside access windows, explaining why, and
+// clipped to the end of an open window
+func TestServeAccessWindows(t *testing.T) {
+	userKey := newTestSigner(t)
+	clock := func(d time.Duration) string {
+		return time.Now().UTC().Add(d).Format("15:04")
+	}
+	yaml := strings.Replace(testUserYaml(userKey), "user_principals:", `access_windows:
+    closed:
+        hours: "`+clock(2*time.Hour)+`-`+clock(3*time.Hour)+`"
+    open:
+        hours: "`+clock(-time.Hour)+`-`+clock(10*time.Minute)+`"
+user_principals:`, 1)
+
+	tests := []struct {
+		name   string
+		window string
+		output string
+	}{
+		{"closed", "closed", "certificates are only issued during closed"},
+		{"open", "open", "certificate generation complete"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := writeTestSettings(t, yaml+"        access_windows: ["+tt.window+"]\n")
+			ts := startTestServer(t, Options{}, settings)
+			keyring, output, err := testClientSession(ts.addr, userKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(output, tt.output) {
+				t.Errorf("output %q does not contain %q", output, tt.output)
+			}
+			certs := testAgentCerts(t, keyring)
+			if tt.window == "closed" {
+				if len(certs) != 0 {
+					t.Error("certificate issued outside access window")
+				}
+				return
+			}
+			if len(certs) != 1 {
+				t.Fatalf("expected one certificate, got %d", len(certs))
+			}
+			expiry := time.Unix(int64(certs[0].ValidBefore), 0)
+			if expiry.After(time.Now().Add(10 * time.Minute)) {
+				t.Errorf("certificate expiry %s not clipped to access window", expiry)
+			}
+		})
+	}
+}
+
+// requests which cannot be issued now are refused before the user is
+// asked for a reason or approvers are asked to approve them
+func TestServeRefusedBeforeApproval(t *testing.T) {
+	userKey := newTestSigner(t)
+	closed := time.Now().UTC().Add(2*time.Hour).Format("15:04") + "-" +
+		time.Now().UTC().Add(3*time.Hour).Format("15:04")
+	yaml := strings.Replace(testUserYaml(userKey), "user_principals:", `access_windows:
+    closed:
+        hours: "`+closed+`"
+approval:
+    principals: [web, root]
+    approvers: [tester]
+user_principals:`, 1) + `        access_windows: [closed]
+        profiles:
+            prod:
+                principals:
+                    - root
+                require_reason: true
+`
+	settings := writeTestSettings(t, yaml)
+	ts := startTestServer(t, Options{}, settings)
+
+	for _, username := range []string{"tester", "prod"} {
+		client, keyring, err := testClientConn(ts.addr, username, userKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		type result struct {
+			output string
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			output, err := testReasonSession(client, "")
+			done <- result{output, err}
+		}()
+
+		var r result
+		timeout := time.After(5 * time.Second)
+	wait:
+		for {
+			if pending := ts.issuer.approvals.list(); len(pending) > 0 {
+				t.Fatalf("%s request outside access window pending approval: %s", username, pending[0])
+			}
+			select {
+			case r = <-done:
+				break wait
+			case <-time.After(10 * time.Millisecond):
+			case <-timeout:
+				t.Fatalf("%s request was not refused", username)
+			}
+		}
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if !strings.Contains(r.output, "certificates are only issued during closed") {
+			t.Errorf("%s got output %q", username, r.output)
+		}
+		if strings.Contains(r.output, "requires a reason") {
+			t.Errorf("%s was asked for a reason: %q", username, r.output)
+		}
+		if certs := testAgentCerts(t, keyring); len(certs) != 0 {
+			t.Errorf("%s certificate issued outside access window", username)
+		}
+	}
+}
+
+// users with sign_user_key are given a certificate for their own key
+// without forwarding an agent
+func TestServeSignUserKey(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey)+"        sign_user_key: true\n")
+	ts := startTestServer(t, Options{}, settings)
+
+	client, keyring, err := testClientConn(ts.addr, "tester", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	output, _ := io.ReadAll(stdout)
+
+	var cert *ssh.Certificate
+	for _, line := range strings.Split(string(output), "\n") {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		if c, ok := pub.(*ssh.Certificate); ok {
+			cert = c
+		}
+	}
+	if cert == nil {
+		t.Fatalf("no certificate in output %q", output)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), userKey.PublicKey().Marshal()) {
+		t.Error("certificate is not for the user's key")
+	}
+	if !bytes.Equal(cert.SignatureKey.Marshal(), ts.issuer.caKey.PublicKey().Marshal()) {
+		t.Error("certificate not signed by the ca")
+	}
+	if keys, _ := keyring.List(); len(keys) != 0 {
+		t.Errorf("unexpected keys added to agent %v", keys)
+	}
+}
+
+// testTOTPCode returns the RFC 6238 code for the base32 secret at t
+func testTOTPCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, at.Unix()/30)
+	sum := mac.Sum(nil)
+	offset := sum[19] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+// users with a totp secret must give a current, unused verification
+// code by keyboard-interactive authentication after their key
+func TestServeTOTP(t *testing.T) {
+	userKey := newTestSigner(t)
+	secret := "JBSWY3DPEHPK3PXPJBSWY3DP"
+	secretsPath := filepath.Join(t.TempDir(), "totp.yaml")
+	if err := os.WriteFile(secretsPath, []byte("tester: "+secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings := writeTestSettings(t, testUserYaml(userKey)+"totp_secrets: "+secretsPath+"\n")
+	ts := startTestServer(t, Options{}, settings)
+
+	answer := func(code string, prompts *[]string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			*prompts = append(*prompts, questions...)
+			return []string{code}, nil
+		})
+	}
+	connect := func(auth ...ssh.AuthMethod) (agent.Agent, error) {
+		client, keyring, err := testClientConn(ts.addr, "tester", userKey, auth...)
+		if err != nil {
+			return keyring, err
+		}
+		defer client.Close()
+		_, err = testAgentSession(client)
+		return keyring, err
+	}
+
+	if _, err := connect(); err == nil {
+		t.Error("user connected without a verification code")
+	}
+	var prompts []string
+	if _, err := connect(answer("000000x", &prompts)); err == nil {
+		t.Error("user connected with an invalid verification code")
+	}
+	if len(prompts) != 1 || prompts[0] != totpPrompt {
+		t.Errorf("got prompts %q", prompts)
+	}
+
+	code := testTOTPCode(t, secret, time.Now())
+	keyring, err := connect(answer(code, &prompts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certs := testAgentCerts(t, keyring); len(certs) != 1 {
+		t.Errorf("expected one certificate, got %d", len(certs))
+	}
+	if _, err := connect(answer(code, &prompts)); err == nil {
+		t.Error("user connected reusing a verification code")
+	}
+}
+
+// users giving too many invalid verification codes, over any number of
+// connections, are locked out even with a valid code
+func TestServeTOTPLockout(t *testing.T) {
+	userKey := newTestSigner(t)
+	secret := "JBSWY3DPEHPK3PXPJBSWY3DP"
+	secretsPath := filepath.Join(t.TempDir(), "totp.yaml")
+	if err := os.WriteFile(secretsPath, []byte("tester: "+secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	settings := writeTestSettings(t, testUserYaml(userKey)+"totp_secrets: "+secretsPath+"\n")
+	ts := startTestServer(t, Options{}, settings)
+
+	connect := func(code string) error {
+		client, _, err := testClientConn(ts.addr, "tester", userKey,
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				return []string{code}, nil
+			}))
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	for i := range totpMaxFailures {
+		if err := connect("000000x"); err == nil {
+			t.Fatalf("attempt %d connected with an invalid verification code", i+1)
+		}
+	}
+	if err := connect(testTOTPCode(t, secret, time.Now())); err == nil {
+		t.Error("locked out user connected with a valid verification code")
+	}
+}
+
+// testReasonSession runs an agent forwarding session on client, giving
+// input on the session's stdin, returning the session output
+func testReasonSession(client *ssh.Client, input string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(stdin, input); err != nil {
+		return "", err
+	}
+	output, _ := io.ReadAll(stdout)
+	return string(output), nil
+}
+
+// profiles may require a reason matching the reason_pattern, which is
+// put in the certificate key id and the ledger
+func TestServeRequireReason(t *testing.T) {
+	userKey := newTestSigner(t)
+	yaml := testUserYaml(userKey) + `        profiles:
+            prod:
+                principals:
+                    - root
+                require_reason: true
+reason_pattern: "INC-[0-9]+"
+`
+	settings := writeTestSettings(t, yaml)
+	ts := startTestServer(t, Options{}, settings)
+
+	tests := []struct {
+		name   string
+		input  string
+		reason string
+	}{
+		{"valid after retry", "\nINC-123\n", "INC-123"},
+		{"invalid", "fixing things\nINC\n\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, keyring, err := testClientConn(ts.addr, "prod", userKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			output, err := testReasonSession(client, tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(output, "requires a reason") {
+				t.Errorf("user not asked for a reason: %q", output)
+			}
+			certs := testAgentCerts(t, keyring)
+			if tt.reason == "" {
+				if len(certs) != 0 || !strings.Contains(output, "no reason given") {
+					t.Errorf("certificate issued without a valid reason: %q", output)
+				}
+				return
+			}
+			if len(certs) != 1 {
+				t.Fatalf("expected one certificate, got %d: %q", len(certs), output)
+			}
+			if !strings.HasSuffix(certs[0].KeyId, "_reason:"+tt.reason) {
+				t.Errorf("reason not in key id %s", certs[0].KeyId)
+			}
+			entries, err := util.ReadLedger(ts.ledgerPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) == 0 || entries[len(entries)-1].Reason != tt.reason {
+				t.Errorf("reason not recorded in ledger %v", entries)
+			}
+		})
+	}
+}
+
+// testExec runs command on the server at addr as user with userKey,
+// returning the combined output
+func testExec(addr, user string, userKey ssh.Signer, command string) (string, error) {
+	client, _, err := testClientConn(addr, user, userKey)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput(command)
+	return string(output), err
+}
+
+// certificates for privileged principals wait for approval by another
+// approver, who is recorded in the ledger
+func TestServeApproval(t *testing.T) {
+	userKey := newTestSigner(t)
+	approverKey := newTestSigner(t)
+	otherKey := newTestSigner(t)
+	pub := func(k ssh.Signer) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.PublicKey())))
+	}
+	yaml := testUserYaml(userKey) + `        profiles:
+            prod:
+                principals:
+                    - root
+    -
+        name: alice
+        sshpublickey: "` + pub(approverKey) + `"
+        principals:
+            - web
+    -
+        name: bob
+        sshpublickey: "` + pub(otherKey) + `"
+        principals:
+            - web
+approval:
+    principals: [root]
+    approvers: [alice, tester]
+`
+	settings := writeTestSettings(t, yaml)
+	ts := startTestServer(t, Options{}, settings)
+
+	// request a certificate, waiting for the request to be pending
+	type result struct {
+		certs  []*ssh.Certificate
+		output string
+		err    error
+	}
+	request := func(id string) chan result {
+		results := make(chan result, 1)
+		go func() {
+			client, keyring, err := testClientConn(ts.addr, "prod", userKey)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer client.Close()
+			output, err := testAgentSession(client)
+			certs, _ := keyring.List()
+			r := result{output: output, err: err}
+			for _, k := range certs {
+				if cert, err := ssh.ParsePublicKey(k.Blob); err == nil {
+					if c, ok := cert.(*ssh.Certificate); ok {
+						r.certs = append(r.certs, c)
+					}
+				}
+			}
+			results <- r
+		}()
+		for range 50 {
+			output, err := testExec(ts.addr, "approve", approverKey, "list")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(output, id+" tester profile prod principals root") {
+				return results
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("request %s not pending", id)
+		return nil
+	}
+
+	results := request("1")
+	if output, err := testExec(ts.addr, "approve", userKey, "approve 1"); err == nil || !strings.Contains(output, "own requests") {
+		t.Errorf("user approved their own request: %q %v", output, err)
+	}
+	if _, err := testExec(ts.addr, "approve", otherKey, "approve 1"); err == nil {
+		t.Error("user who is not an approver approved a request")
+	}
+	if output, err := testExec(ts.addr, "approve", approverKey, "approve 1"); err != nil {
+		t.Fatalf("could not approve request: %q %v", output, err)
+	}
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if len(r.certs) != 1 || !strings.Contains(r.output, "approved by alice") {
+		t.Fatalf("expected one approved certificate, got %d: %q", len(r.certs), r.output)
+	}
+	entries, err := util.ReadLedger(ts.ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ApprovedBy != "alice" {
+		t.Errorf("approver not recorded in ledger %v", entries)
+	}
+
+	results = request("2")
+	if output, err := testExec(ts.addr, "approve", approverKey, "deny 2"); err != nil {
+		t.Fatalf("could not deny request: %q %v", output, err)
+	}
+	r = <-results
+	if len(r.certs) != 0 || !strings.Contains(r.output, "certificate request denied") {
+		t.Errorf("denied request issued %d certificates: %q", len(r.certs), r.output)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/sshagentca/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// agentOnlyWait is the time a session which has requested agent
+// forwarding waits for a shell or exec request before issuing a
+// certificate, for clients which only forward an agent
+const agentOnlyWait = 500 * time.Millisecond
+
+var (
+	errRequestNotSupported = errors.New("request type not supported")
+	errNoAgent             = errors.New("no agent forwarded, connect with ssh -A")
+	errShuttingDown        = errors.New("server shutting down")
+)
+
+// sessionSetup records the requests setting up a session before it
+// starts with a shell or exec request
+type sessionSetup struct {
+	agent   bool              // agent forwarding requested
+	pty     bool              // pty requested
+	env     map[string]string // environment variables sent
+	exec    bool              // started with exec rather than shell
+	command string            // the exec command
+}
+
+// readSession reads the requests setting up a session until the session
+// starts. Sessions start with a shell or exec request or, if only agent
+// forwarding is requested, after agentOnlyWait.
+func readSession(reqs <-chan *ssh.Request) (*sessionSetup, error) {
+
+	setup := &sessionSetup{env: map[string]string{}}
+	var agentOnly <-chan time.Time
+
+	for {
+		var req *ssh.Request
+		select {
+		case req = <-reqs:
+		case <-agentOnly:
+			return setup, nil
+		}
+		if req == nil {
+			return nil, io.EOF
+		}
+
+		ok := true
+		switch req.Type {
+		case "auth-agent-req@openssh.com":
+			setup.agent = true
+			agentOnly = time.After(agentOnlyWait)
+		case "pty-req":
+			setup.pty = true
+		case "env":
+			var env struct{ Name, Value string }
+			if ok = ssh.Unmarshal(req.Payload, &env) == nil; ok {
+				setup.env[env.Name] = env.Value
+			}
+		case "exec":
+			var exec struct{ Command string }
+			if ok = ssh.Unmarshal(req.Payload, &exec) == nil; ok {
+				setup.exec, setup.command = true, exec.Command
+			}
+		case "shell":
+		case "subsystem":
+			_ = req.Reply(false, nil)
+			return nil, errRequestNotSupported
+		default:
+			ok = false
+		}
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+		if ok && (req.Type == "shell" || req.Type == "exec") {
+			return setup, nil
+		}
+	}
+}
+
+// SessionOptions are the options of the commands clients may run with
+// exec, such as `ssh sshagentca whoami --json`
+type SessionOptions struct {
+	JSON       bool     `long:"json" description:"write the results as json"`
+	Principals []string `long:"principals" description:"request only these principals"`
+	Validity   string   `long:"validity" description:"request a shorter validity"`
+}
+
+// environment variables, which clients may send with SendEnv, requesting
+// principals and a validity when these options are not given
+const (
+	principalsEnv = "SSHAGENTCA_PRINCIPALS"
+	validityEnv   = "SSHAGENTCA_VALIDITY"
+)
+
+// session is a client session in which a command is run for the
+// certificate request of the connection
+type session struct {
+	ctx     context.Context // cancelled when the server shuts down
+	ch      ssh.Channel
+	sshConn *ssh.ServerConn
+	issuer  *certIssuer
+	certReq *certRequest
+	setup   *sessionSetup
+	options SessionOptions
+	term    *term.Terminal // messages and prompts for the user
+
+	entitled *util.CertSpec // the certificate spec before any restriction
+}
+
+// sessionCommands are the commands clients may run with exec. Sessions
+// started with a shell issue a certificate.
+var sessionCommands = map[string]func(*session) error{
+	"issue":  (*session).issue,
+	"whoami": (*session).whoami,
+	"status": (*session).status,
+}
+
+// sessionUsage describes the session commands
+const sessionUsage = `commands:
+  issue   issue a certificate (the default)
+  whoami  show the user, key and certificate settings
+  status  show if a certificate can be issued now
+  help    show this help
+
+options:
+  --json                write the results as json
+  --principals <list>   request only some of your principals, such as web,db
+  --validity <minutes>  request a shorter validity, such as 15 or 1h
+
+SSHAGENTCA_PRINCIPALS and SSHAGENTCA_VALIDITY may be sent with SendEnv
+instead of --principals and --validity`
+
+// parseCommand parses an exec command line into the command to run and
+// its options. An empty command line issues a certificate.
+func parseCommand(line string) (func(*session) error, SessionOptions, error) {
+	var options SessionOptions
+	parser := flags.NewParser(&options, flags.PassDoubleDash)
+	args, err := parser.ParseArgs(strings.Fields(line))
+	if err != nil {
+		return nil, options, err
+	}
+	if len(args) == 0 {
+		return (*session).issue, options, nil
+	}
+	if len(args) > 1 {
+		return nil, options, fmt.Errorf("%s: unexpected argument %s", args[0], args[1])
+	}
+	if args[0] == "help" {
+		return (*session).help, options, nil
+	}
+	cmd, ok := sessionCommands[args[0]]
+	if !ok {
+		return nil, options, fmt.Errorf("unknown command %s, use one of %s",
+			args[0], strings.Join(slices.Sorted(maps.Keys(sessionCommands)), ", "))
+	}
+	return cmd, options, nil
+}
+
+// run the command given by the session setup, issuing a certificate if
+// the session started with a shell. With --json, results and errors are
+// written to the session as json and messages for the user to stderr.
+func (s *session) run() error {
+
+	cmd, options, err := parseCommand(s.setup.command)
+	s.options = options
+	if s.options.JSON {
+		s.term = term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{s.ch, s.ch.Stderr()}, "")
+	} else {
+		s.term = term.NewTerminal(s.ch, "")
+	}
+	if err == nil {
+		err = s.restrict()
+	}
+	if err == nil {
+		err = cmd(s)
+	}
+	if err != nil && s.options.JSON {
+		_ = s.writeJSON(struct {
+			Error string `json:"error"`
+		}{err.Error()})
+	} else if err != nil {
+		termWriter(s.term, err.Error())
+	}
+	if !s.options.JSON {
+		termWriter(s.term, "goodbye\n")
+	}
+	return err
+}
+
+// restrict the certificate request to the principals and validity
+// requested by the options or, failing these, the environment
+func (s *session) restrict() error {
+	var principals []string
+	for _, p := range s.options.Principals {
+		principals = append(principals, util.ParsePrincipals(p)...)
+	}
+	if len(s.options.Principals) == 0 {
+		principals = util.ParsePrincipals(s.setup.env[principalsEnv])
+	}
+	validityArg := s.options.Validity
+	if validityArg == "" {
+		validityArg = s.setup.env[validityEnv]
+	}
+	if len(principals) == 0 && validityArg == "" {
+		return nil
+	}
+	var validity uint32
+	var err error
+	if validityArg != "" {
+		validity, err = util.ParseValidity(validityArg)
+		if err != nil {
+			return err
+		}
+	}
+	req := s.certReq
+	s.entitled = req.spec
+	spec, err := req.settings.Restrict(req.spec, principals, validity)
+	if err != nil {
+		log.Printf("user %s request refused: %s", req.user.Name, err)
+		return err
+	}
+	log.Printf("user %s requested principals %s for %d minutes", req.user.Name, spec.Principals, spec.Validity)
+	req.spec = spec
+	return nil
+}
+
+// writeJSON writes v to the session as json
+func (s *session) writeJSON(v any) error {
+	return json.NewEncoder(s.ch).Encode(v)
+}
+
+// help describes the session commands
+func (s *session) help() error {
+	termWriter(s.term, sessionUsage)
+	return nil
+}
+
+// issueResult is the json result of the issue command
+type issueResult struct {
+	Serial      uint64    `json:"serial"`
+	KeyID       string    `json:"key_id"`
+	Principals  []string  `json:"principals"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	ApprovedBy  string    `json:"approved_by,omitempty"`
+	Certificate string    `json:"certificate,omitempty"`
+}
+
+// issue a certificate: add a certificate for a new key to the user's
+// agent, or give the user a certificate for their own key
+func (s *session) issue() error {
+
+	certReq, settings, user := s.certReq, s.certReq.settings, s.certReq.user
+	var err error
+
+	termWriter(s.term, settings.Banner)
+	termWriter(s.term, fmt.Sprintf("welcome, %s", user.Name))
+
+	// users whose own key is signed do not need a forwarded agent
+	if !user.SignUserKey && !s.setup.agent {
+		log.Printf("user %s did not forward an agent", user.Name)
+		return errNoAgent
+	}
+
+	// users waiting to give input are disconnected if the server shuts
+	// down, while certificates being issued are completed
+	interactive := s.setup.pty && !s.setup.exec
+	stopWaiting := func() bool { return true }
+	if interactive || certReq.spec.RequireReason || certReq.spec.RequireApproval {
+		stopWaiting = closeOnShutdown(s.ctx, s.sshConn, user.Name)
+		defer stopWaiting()
+	}
+
+	// users of interactive sessions choose their principals and
+	// validity from a menu
+	if interactive {
+		entitled := s.entitled
+		if entitled == nil {
+			entitled = certReq.spec
+		}
+		certReq.spec, err = pick(s.term, s.sshConn, newPicker(settings, user, entitled, certReq.spec))
+		if err != nil {
+			log.Printf("user %s did not choose a certificate: %s", user.Name, err)
+			return errPickCancelled
+		}
+		log.Printf("user %s chose profile %q principals %s for %d minutes",
+			user.Name, certReq.spec.Profile, certReq.spec.Principals, certReq.spec.Validity)
+	}
+
+	// refuse certificates which cannot be issued now, because of the
+	// user's account dates or access windows, before asking for a
+	// reason or approval; sign checks these again when issuing
+	if _, _, err := certValidity(certReq, time.Now()); err != nil {
+		log.Printf("user %s certificate refused: %s", user.Name, err)
+		return err
+	}
+
+	// ask for the reason for the certificate if the profile
+	// requires one
+	if certReq.spec.RequireReason {
+		certReq.reason, err = readReason(s.term, s.sshConn, settings)
+		if err != nil {
+			log.Printf("user %s gave no reason for profile %s: %s", user.Name, certReq.spec.Profile, err)
+			return errors.New("no reason given")
+		}
+		log.Printf("user %s gave reason %q for profile %s", user.Name, certReq.reason, certReq.spec.Profile)
+	}
+
+	// wait for a second person to approve privileged principals
+	if certReq.spec.RequireApproval {
+		certReq.approver, err = awaitApproval(s.term, s.sshConn, s.issuer.approvals, certReq)
+		if err != nil {
+			log.Printf("user %s certificate not approved: %s", user.Name, err)
+			return err
+		}
+		log.Printf("user %s certificate approved by %s", user.Name, certReq.approver)
+		termWriter(s.term, fmt.Sprintf("approved by %s", certReq.approver))
+	}
+
+	if !stopWaiting() {
+		return errShuttingDown
+	}
+
+	// add certificate to agent, or give the user the certificate for
+	// their own key
+	var cert *ssh.Certificate
+	if user.SignUserKey {
+		cert, err = signUserKey(s.issuer, certReq)
+	} else {
+		var agentConn agent.ExtendedAgent
+		agentConn, err = openAgent(s.sshConn)
+		if err == nil {
+			cert, err = addCertToAgent(agentConn, s.issuer, certReq)
+		}
+	}
+	if err != nil {
+		log.Printf("certificate creation error %s\n", err)
+		var windowErr *util.WindowError
+		if errors.As(err, &windowErr) {
+			termWriter(s.term, windowErr.Error())
+		}
+		return errors.New("certificate creation error")
+	}
+
+	certLine := fmt.Sprintf("%s %s_serial:%d",
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))), cert.KeyId, cert.Serial)
+	if user.SignUserKey {
+		log.Printf("certificate creation for user key done\n")
+	} else {
+		log.Printf("certificate creation and insertion in agent done\n")
+		certLine = ""
+	}
+
+	if s.options.JSON {
+		return s.writeJSON(issueResult{
+			Serial:      cert.Serial,
+			KeyID:       cert.KeyId,
+			Principals:  cert.ValidPrincipals,
+			ValidAfter:  time.Unix(int64(cert.ValidAfter), 0).UTC(),
+			ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC(),
+			ApprovedBy:  certReq.approver,
+			Certificate: certLine,
+		})
+	}
+	termWriter(s.term, "certificate generation complete")
+	if certLine != "" {
+		termWriter(s.term, fmt.Sprintf("save the certificate below for key %s as the", certReq.key))
+		termWriter(s.term, "key's -cert.pub file, for example ~/.ssh/id_ed25519_sk-cert.pub")
+		termWriter(s.term, certLine)
+	} else {
+		termWriter(s.term, "run 'ssh-add -l' to view")
+	}
+	return nil
+}
+
+// openAgent opens the agent forwarded by the client
+func openAgent(sshConn *ssh.ServerConn) (agent.ExtendedAgent, error) {
+	// https://lists.gt.net/openssh/dev/72190
+	agentChan, reqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open agent channel %w", err)
+	}
+	// discard incoming out-of-band requests
+	go ssh.DiscardRequests(reqs)
+	return agent.NewClient(agentChan), nil
+}
+
+// whoamiResult is the result of the whoami command
+type whoamiResult struct {
+	User        string   `json:"user"`
+	Key         string   `json:"key"`
+	KeyLabel    string   `json:"key_label,omitempty"`
+	Profile     string   `json:"profile,omitempty"`
+	Profiles    []string `json:"profiles,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	Principals  []string `json:"principals"`
+	Validity    uint32   `json:"validity_minutes"`
+	KeyType     string   `json:"key_type"`
+	SignUserKey bool     `json:"sign_user_key,omitempty"`
+}
+
+// whoami shows the user, the key they connected with and the settings
+// of the certificate they would be issued
+func (s *session) whoami() error {
+	req := s.certReq
+	keyType := req.spec.KeyType
+	if keyType == "" {
+		keyType = util.DefaultKeyType
+	}
+	if req.user.SignUserKey {
+		keyType = req.key.PublicKey.Type()
+	}
+	r := whoamiResult{
+		User:        req.user.Name,
+		Key:         req.key.Fingerprint,
+		KeyLabel:    req.key.Label,
+		Profile:     req.spec.Profile,
+		Profiles:    slices.Sorted(maps.Keys(req.user.Profiles)),
+		Groups:      req.user.Groups,
+		Principals:  req.spec.Principals,
+		Validity:    req.spec.Validity,
+		KeyType:     keyType,
+		SignUserKey: req.user.SignUserKey,
+	}
+	if s.options.JSON {
+		return s.writeJSON(r)
+	}
+	termWriter(s.term, fmt.Sprintf("user: %s", r.User))
+	termWriter(s.term, fmt.Sprintf("key: %s", req.key))
+	if r.Profile != "" {
+		termWriter(s.term, fmt.Sprintf("profile: %s", r.Profile))
+	}
+	if len(r.Profiles) > 0 {
+		termWriter(s.term, fmt.Sprintf("profiles: %s", strings.Join(r.Profiles, ", ")))
+	}
+	if len(r.Groups) > 0 {
+		termWriter(s.term, fmt.Sprintf("groups: %s", strings.Join(r.Groups, ", ")))
+	}
+	termWriter(s.term, fmt.Sprintf("principals: %s", strings.Join(r.Principals, ", ")))
+	termWriter(s.term, fmt.Sprintf("validity: %d minutes", r.Validity))
+	termWriter(s.term, fmt.Sprintf("key type: %s", r.KeyType))
+	return nil
+}
+
+// statusResult is the result of the status command
+type statusResult struct {
+	Issuable        bool       `json:"issuable"`
+	Message         string     `json:"message,omitempty"`
+	ValidBefore     *time.Time `json:"valid_before,omitempty"`
+	RequireReason   bool       `json:"require_reason,omitempty"`
+	RequireApproval bool       `json:"require_approval,omitempty"`
+	AccountUntil    *time.Time `json:"account_valid_until,omitempty"`
+}
+
+// status shows if a certificate can be issued now and, if so, when it
+// would expire
+func (s *session) status() error {
+	req := s.certReq
+	r := statusResult{
+		RequireReason:   req.spec.RequireReason,
+		RequireApproval: req.spec.RequireApproval,
+	}
+	if !req.user.ValidUntil.IsZero() {
+		r.AccountUntil = &req.user.ValidUntil
+	}
+	_, to, err := certValidity(req, time.Now())
+	if err != nil {
+		r.Message = err.Error()
+	} else {
+		r.Issuable = true
+		r.ValidBefore = &to
+	}
+	if s.options.JSON {
+		return s.writeJSON(r)
+	}
+	if r.Issuable {
+		termWriter(s.term, fmt.Sprintf("a certificate issued now expires at %s", to.Format(util.KeyIDToFormat)))
+	} else {
+		termWriter(s.term, fmt.Sprintf("certificates cannot be issued now: %s", r.Message))
+	}
+	if r.RequireReason {
+		termWriter(s.term, "a reason is required")
+	}
+	if r.RequireApproval {
+		termWriter(s.term, "approval is required")
+	}
+	if r.AccountUntil != nil {
+		termWriter(s.term, fmt.Sprintf("account valid until %s", r.AccountUntil.UTC().Format(util.KeyIDToFormat)))
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		json bool
+		err  string
+	}{
+		{line: ""},
+		{line: "issue"},
+		{line: "whoami --json", json: true},
+		{line: "status -- "},
+		{line: "help"},
+		{line: "unknown", err: "unknown command unknown, use one of issue, status, whoami"},
+		{line: "whoami --nope", err: "unknown flag `nope'"},
+		{line: "status extra", err: "status: unexpected argument extra"},
+	} {
+		t.Run(tt.line, func(t *testing.T) {
+			cmd, options, err := parseCommand(tt.line)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd == nil {
+				t.Error("no command")
+			}
+			if options.JSON != tt.json {
+				t.Errorf("got json %t want %t", options.JSON, tt.json)
+			}
+		})
+	}
+}
+
+// clients may forward an agent and run a command in the same session,
+// with json output when asked
+func TestServeExec(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey))
+	ts := startTestServer(t, Options{}, settings)
+
+	t.Run("issue", func(t *testing.T) {
+		client, keyring, err := testClientConn(ts.addr, "tester", userKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			t.Fatal(err)
+		}
+		output, err := session.Output("issue --json")
+		if err != nil {
+			t.Fatalf("issue failed: %s %s", err, output)
+		}
+		var result issueResult
+		if err := json.Unmarshal(output, &result); err != nil {
+			t.Fatalf("could not decode %q: %s", output, err)
+		}
+		certs := testAgentCerts(t, keyring)
+		if len(certs) != 1 {
+			t.Fatalf("expected one certificate, got %d", len(certs))
+		}
+		if result.Serial != certs[0].Serial || result.KeyID != certs[0].KeyId {
+			t.Errorf("result %+v does not describe certificate %d %s", result, certs[0].Serial, certs[0].KeyId)
+		}
+		if result.ValidBefore.Sub(result.ValidAfter).Minutes() != 30 {
+			t.Errorf("unexpected validity %s to %s", result.ValidAfter, result.ValidBefore)
+		}
+	})
+
+	t.Run("issue without agent", func(t *testing.T) {
+		output, err := testExec(ts.addr, "tester", userKey, "issue")
+		if err == nil {
+			t.Error("expected exit status error")
+		}
+		if !strings.Contains(output, errNoAgent.Error()) {
+			t.Errorf("unexpected output %q", output)
+		}
+	})
+
+	t.Run("whoami", func(t *testing.T) {
+		output, err := testExec(ts.addr, "tester", userKey, "whoami --json")
+		if err != nil {
+			t.Fatalf("whoami failed: %s %s", err, output)
+		}
+		var result whoamiResult
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("could not decode %q: %s", output, err)
+		}
+		if result.User != "tester" || result.Validity != 30 || strings.Join(result.Principals, ",") != "web" {
+			t.Errorf("unexpected result %+v", result)
+		}
+		output, err = testExec(ts.addr, "tester", userKey, "whoami")
+		if err != nil || !strings.Contains(output, "principals: web") {
+			t.Errorf("unexpected output %q %v", output, err)
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		output, err := testExec(ts.addr, "tester", userKey, "status --json")
+		if err != nil {
+			t.Fatalf("status failed: %s %s", err, output)
+		}
+		var result statusResult
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("could not decode %q: %s", output, err)
+		}
+		if !result.Issuable || result.ValidBefore == nil {
+			t.Errorf("unexpected result %+v", result)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		output, err := testExec(ts.addr, "tester", userKey, "unknown --json")
+		if err == nil {
+			t.Error("expected exit status error")
+		}
+		var result struct{ Error string }
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			t.Fatalf("could not decode %q: %s", output, err)
+		}
+		if !strings.HasPrefix(result.Error, "unknown command") {
+			t.Errorf("unexpected error %q", result.Error)
+		}
+	})
+}
+
+// testIssueSession forwards an agent and runs command with the
+// environment variables env, returning the session output
+func testIssueSession(client *ssh.Client, command string, env map[string]string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	for k, v := range env {
+		if err := session.Setenv(k, v); err != nil {
+			return "", err
+		}
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return "", err
+	}
+	output, err := session.CombinedOutput(command)
+	return string(output), err
+}
+
+// clients may request some of their principals and a shorter validity
+// with options or environment variables, but nothing beyond these
+func TestServeRestrict(t *testing.T) {
+	userKey := newTestSigner(t)
+	settings := writeTestSettings(t, testUserYaml(userKey)+"            - db\n")
+	ts := startTestServer(t, Options{}, settings)
+
+	tests := []struct {
+		name       string
+		command    string
+		env        map[string]string
+		principals []string
+		validity   uint64
+		err        string
+	}{
+		{name: "default", command: "issue", principals: []string{"web", "db"}, validity: 30},
+		{name: "options", command: "issue --principals web --validity 15m", principals: []string{"web"}, validity: 15},
+		{name: "environment", command: "issue", env: map[string]string{principalsEnv: "db", validityEnv: "10"},
+			principals: []string{"db"}, validity: 10},
+		{name: "options override environment", command: "issue --principals web", env: map[string]string{principalsEnv: "db"},
+			principals: []string{"web"}, validity: 30},
+		{name: "principal not permitted", command: "issue --principals web,root", err: "principal root is not permitted"},
+		{name: "validity too long", command: "issue --validity 1h", err: "validity 60 minutes exceeds the maximum of 30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, keyring, err := testClientConn(ts.addr, "tester", userKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			output, err := testIssueSession(client, tt.command, tt.env)
+			certs := testAgentCerts(t, keyring)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(output, tt.err) {
+					t.Errorf("got output %q error %v want %q", output, err, tt.err)
+				}
+				if len(certs) != 0 {
+					t.Errorf("certificate issued for refused request")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("issue failed: %s %s", err, output)
+			}
+			if len(certs) != 1 {
+				t.Fatalf("expected one certificate, got %d", len(certs))
+			}
+			if !slices.Equal(certs[0].ValidPrincipals, tt.principals) {
+				t.Errorf("got principals %v want %v", certs[0].ValidPrincipals, tt.principals)
+			}
+			if got := certs[0].ValidBefore - certs[0].ValidAfter; got != tt.validity*60 {
+				t.Errorf("got validity %d want %d", got, tt.validity*60)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rorycl/sshagentca/util"
+	"golang.org/x/crypto/ssh"
+)
+
+// totpPrompt is the keyboard-interactive prompt for a TOTP code
+const totpPrompt = "Verification code: "
+
+// totpReplay records the time step of the last TOTP code accepted for
+// each user, so that a code cannot be used twice
+type totpReplay struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+func newTOTPReplay() *totpReplay {
+	return &totpReplay{last: map[string]int64{}}
+}
+
+// use records the use of a code for step by the user, reporting false
+// if a code for this or a later step has already been used
+func (r *totpReplay) use(user string, step int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if last, ok := r.last[user]; ok && step <= last {
+		return false
+	}
+	r.last[user] = step
+	return true
+}
+
+// totpMaxFailures is the number of invalid TOTP codes a user may give
+// within totpFailureWindow before further codes are refused until the
+// earliest of these failures is older than the window
+const (
+	totpMaxFailures   = 5
+	totpFailureWindow = 15 * time.Minute
+)
+
+// errTOTPLocked is returned to users who have given too many invalid
+// TOTP codes
+var errTOTPLocked = errors.New("too many invalid verification codes, try again later")
+
+// totpFailures records the times of each user's recent invalid TOTP
+// codes, across all connections, to limit guessing of codes
+type totpFailures struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+func newTOTPFailures() *totpFailures {
+	return &totpFailures{failures: map[string][]time.Time{}}
+}
+
+// recent returns the user's failures within the window before now
+func (f *totpFailures) recent(user string, now time.Time) []time.Time {
+	recent := f.failures[user][:0]
+	for _, t := range f.failures[user] {
+		if now.Sub(t) < totpFailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(f.failures, user)
+		return nil
+	}
+	f.failures[user] = recent
+	return recent
+}
+
+// locked reports if the user has too many recent failures to try
+// another code
+func (f *totpFailures) locked(user string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.recent(user, now)) >= totpMaxFailures
+}
+
+// fail records a failure by the user, reporting if the user is now
+// locked out
+func (f *totpFailures) fail(user string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[user] = append(f.recent(user, now), now)
+	return len(f.failures[user]) >= totpMaxFailures
+}
+
+// totpCallbacks returns the keyboard-interactive authentication step
+// which asks a user who has authenticated with their key for a TOTP
+// code, granting perms if the code is valid and unused. Users with too
+// many recent invalid codes are refused without their code being checked.
+func totpCallbacks(s *util.Settings, user *util.UserPrincipals, key *util.UserKey, replay *totpReplay,
+	failures *totpFailures, perms *ssh.Permissions) ssh.ServerAuthCallbacks {
+	return ssh.ServerAuthCallbacks{
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{totpPrompt}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 {
+				return nil, errors.New("expected one verification code")
+			}
+			now := time.Now()
+			if failures.locked(user.Name, now) {
+				log.Printf("rejected key %s: user %s is locked out after invalid verification codes", key, user.Name)
+				return nil, errTOTPLocked
+			}
+			step, err := s.CheckTOTP(user, answers[0], now)
+			if err != nil {
+				log.Printf("rejected key %s: %s", key, err)
+				if failures.fail(user.Name, now) {
+					log.Printf("user %s locked out for up to %s after %d invalid verification codes",
+						user.Name, totpFailureWindow, totpMaxFailures)
+				}
+				return nil, err
+			}
+			if !replay.use(user.Name, step) {
+				log.Printf("rejected key %s: verification code reused", key)
+				return nil, util.ErrTOTPInvalid
+			}
+			return perms, nil
+		},
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPFailures(t *testing.T) {
+	f := newTOTPFailures()
+	now := time.Now()
+	for i := range totpMaxFailures {
+		if f.locked("jane", now) {
+			t.Fatalf("locked after %d failures", i)
+		}
+		if locked := f.fail("jane", now.Add(time.Duration(i)*time.Minute)); locked != (i == totpMaxFailures-1) {
+			t.Errorf("failure %d reported locked %t", i+1, locked)
+		}
+	}
+	later := now.Add(time.Duration(totpMaxFailures-1) * time.Minute)
+	if !f.locked("jane", later) {
+		t.Error("not locked after too many failures")
+	}
+	if f.locked("john", later) {
+		t.Error("other user locked")
+	}
+
+	// the lock lifts as the earliest failure leaves the window
+	if f.locked("jane", now.Add(totpFailureWindow)) {
+		t.Error("still locked after the earliest failure left the window")
+	}
+	if !f.fail("jane", now.Add(totpFailureWindow)) {
+		t.Error("a further failure within the window did not lock")
+	}
+	if f.locked("jane", later.Add(2*totpFailureWindow)) {
+		t.Error("still locked after all failures left the window")
+	}
+	if len(f.failures) != 0 {
+		t.Errorf("failures not forgotten: %v", f.failures)
+	}
+}
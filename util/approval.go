@@ -0,0 +1,87 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ApproveUsername is the login username with which approvers connect
+// to list, approve and deny pending certificate requests
+const ApproveUsername = "approve"
+
+// DefaultApprovalTimeout is the time in minutes a request waits for
+// approval if no timeout is set
+const DefaultApprovalTimeout uint32 = 5
+
+// maxApprovalTimeout is the longest time in minutes a request may wait
+// for approval
+const maxApprovalTimeout uint32 = 60
+
+// Approval sets out the principals whose certificates must be approved
+// by a second person, the users who may approve them and the time in
+// minutes a request waits for approval. Users may not approve their own
+// requests.
+type Approval struct {
+	Principals []string `yaml:"principals"`
+	Approvers  []string `yaml:"approvers"`
+	Timeout    uint32   `yaml:"timeout"`
+}
+
+// ApprovalRequired reports if any certificates require approval
+func (s *Settings) ApprovalRequired() bool {
+	return s.Approval != nil && len(s.Approval.Principals) > 0
+}
+
+// IsApprover reports if the user may approve certificate requests
+func (s *Settings) IsApprover(user *UserPrincipals) bool {
+	return s.ApprovalRequired() && slices.Contains(s.Approval.Approvers, user.Name)
+}
+
+// ApprovalTimeout is the time a request waits for approval
+func (s *Settings) ApprovalTimeout() time.Duration {
+	if !s.ApprovalRequired() || s.Approval.Timeout == 0 {
+		return time.Duration(DefaultApprovalTimeout) * time.Minute
+	}
+	return time.Duration(s.Approval.Timeout) * time.Minute
+}
+
+// requiresApproval reports if any of the principals require approval
+func (s *Settings) requiresApproval(principals []string) bool {
+	if !s.ApprovalRequired() {
+		return false
+	}
+	return slices.ContainsFunc(principals, func(p string) bool {
+		return slices.Contains(s.Approval.Principals, p)
+	})
+}
+
+// validateApproval checks the approvers are users, the timeout is
+// within limits and that no profile is named for the approve username
+func (s *Settings) validateApproval() error {
+	if s.Approval == nil {
+		return nil
+	}
+	a := s.Approval
+	if len(a.Principals) == 0 {
+		return errors.New("approval provided with no principals")
+	}
+	if len(a.Approvers) == 0 {
+		return errors.New("approval provided with no approvers")
+	}
+	if a.Timeout > maxApprovalTimeout {
+		return fmt.Errorf("approval timeout must be <=%d", maxApprovalTimeout)
+	}
+	for _, name := range a.Approvers {
+		if !slices.ContainsFunc(s.Users, func(u *UserPrincipals) bool { return u.Name == name }) {
+			return fmt.Errorf("approval approver %s is not a user", name)
+		}
+	}
+	for _, u := range s.Users {
+		if _, ok := u.Profiles[ApproveUsername]; ok {
+			return u.sourceError(fmt.Errorf("user %s profile %s is reserved for approvers", u.Name, ApproveUsername))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApprovalRequired(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	alice := settings.Users[0]
+	settings.Approval = &Approval{Principals: []string{"ALICE"}, Approvers: []string{"alice"}}
+	if err := settings.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for profile, want := range map[string]bool{"": false, "admin": true} {
+		spec, err := settings.CertSpec(alice, profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spec.RequireApproval != want {
+			t.Errorf("profile %q got require approval %t", profile, spec.RequireApproval)
+		}
+	}
+	if !settings.IsApprover(alice) {
+		t.Error("alice is not an approver")
+	}
+	if got := settings.ApprovalTimeout(); got != 5*time.Minute {
+		t.Errorf("got default approval timeout %s", got)
+	}
+}
+
+func TestApprovalValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		approval *Approval
+		profile  string
+		err      string
+	}{
+		{"valid", &Approval{Principals: []string{"root"}, Approvers: []string{"alice"}, Timeout: 10}, "", ""},
+		{"no principals", &Approval{Approvers: []string{"alice"}}, "", "approval provided with no principals"},
+		{"no approvers", &Approval{Principals: []string{"root"}}, "", "approval provided with no approvers"},
+		{"unknown approver", &Approval{Principals: []string{"root"}, Approvers: []string{"bob"}}, "", "approval approver bob is not a user"},
+		{"timeout", &Approval{Principals: []string{"root"}, Approvers: []string{"alice"}, Timeout: 61}, "", "approval timeout must be <=60"},
+		{"reserved profile", &Approval{Principals: []string{"root"}, Approvers: []string{"alice"}}, ApproveUsername, "user alice profile approve is reserved for approvers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := SettingsLoad("testdata/settings_templates.yaml")
+			if err != nil {
+				t.Fatalf("Could not parse yaml %v", err)
+			}
+			settings.Approval = tt.approval
+			if tt.profile != "" {
+				settings.Users[0].Profiles[tt.profile] = settings.Users[0].Profiles["admin"]
+			}
+			err = settings.validate()
+			t.Log(err)
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package util
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// CertSpec sets out the parameters of a certificate to be issued to a
+// user, resolved from the global settings and those of the user and
+// the selected profile
+type CertSpec struct {
+	Profile           string // empty for the user's default settings
+	Principals        []string
+	Validity          uint32 // minutes
+	Extensions        map[string]string
+	CriticalOptions   map[string]string
+	BindSourceAddress *SourceBinding
+	AccessWindows     []string // any time if empty
+	KeyType           string   // DefaultKeyType if empty
+	RequireReason     bool
+	RequireApproval   bool // principals require a second person's approval
+}
+
+// IsProfileName reports if any user has a profile with this name
+func (s *Settings) IsProfileName(name string) bool {
+	for _, u := range s.Users {
+		if _, ok := u.Profiles[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectProfile determines the profile selected by the username a
+// client used to connect. The user's default settings, indicated by
+// an empty profile name, are used if the username does not name a
+// profile; an error is returned if the username names a profile held
+// by other users but not by this user.
+func (s *Settings) SelectProfile(user *UserPrincipals, username string) (string, error) {
+	if _, ok := user.Profiles[username]; ok {
+		return username, nil
+	}
+	if s.IsProfileName(username) {
+		return "", fmt.Errorf("user %s is not entitled to profile %s", user.Name, username)
+	}
+	return "", nil
+}
+
+// CertSpec resolves the certificate parameters for user with the named
+// profile, or the user's default settings if profile is empty. Settings
+// are taken in turn from the global settings, the user's groups, the
+// user and the profile. Templated principals are rendered for the user
+// and profile.
+func (s *Settings) CertSpec(user *UserPrincipals, profile string) (*CertSpec, error) {
+
+	groups, err := s.resolveGroups(user.Groups)
+	if err != nil {
+		return nil, fmt.Errorf("user %s %w", user.Name, err)
+	}
+
+	data := TemplateData{Name: user.Name}
+	spec := &CertSpec{
+		Validity:        s.Validity,
+		Extensions:      s.Extensions,
+		CriticalOptions: s.CriticalOptions,
+		KeyType:         s.KeyType,
+	}
+	spec.applyGroups(groups)
+	spec.override(user.CertOptions)
+	if profile == "" {
+		spec.Principals, err = renderPrincipals(user.Principals, groups, data)
+		if err != nil {
+			return nil, fmt.Errorf("user %s %w", user.Name, err)
+		}
+		spec.RequireApproval = s.requiresApproval(spec.Principals)
+		return spec, nil
+	}
+
+	p, ok := user.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("user %s has no profile %s", user.Name, profile)
+	}
+	data.Profile = profile
+	spec.Profile = profile
+	spec.RequireReason = p.RequireReason
+	spec.Principals, err = renderPrincipals(p.Principals, nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("user %s profile %s %w", user.Name, profile, err)
+	}
+	spec.override(p.CertOptions)
+	spec.RequireApproval = s.requiresApproval(spec.Principals)
+	return spec, nil
+}
+
+// renderPrincipals renders the principals and those of the groups with
+// data, without duplicates. Only group principals may include the name
+// of the group granting them as {{.Group}}.
+func renderPrincipals(principals []string, groups []*Group, data TemplateData) ([]string, error) {
+	rendered := []string{}
+	add := func(principals []string, data any) error {
+		for _, text := range principals {
+			p, err := renderTemplate(text, data)
+			if err != nil {
+				return fmt.Errorf("principal %s: %w", text, err)
+			}
+			if p == "" || strings.ContainsAny(p, ", \t\r\n") {
+				return fmt.Errorf("principal %s renders to invalid principal %q", text, p)
+			}
+			if !slices.Contains(rendered, p) {
+				rendered = append(rendered, p)
+			}
+		}
+		return nil
+	}
+	if err := add(principals, data); err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if err := add(g.Principals, GroupTemplateData{data, g.name}); err != nil {
+			return nil, fmt.Errorf("group %s %w", g.name, err)
+		}
+	}
+	return rendered, nil
+}
+
+// validateUserSpecs checks the principals, extensions and key id of
+// each user and profile render to permitted values
+func (s *Settings) validateUserSpecs() error {
+	for _, u := range s.Users {
+		profiles := append([]string{""}, slices.Sorted(maps.Keys(u.Profiles))...)
+		for _, p := range profiles {
+			spec, err := s.CertSpec(u, p)
+			if err != nil {
+				return u.sourceError(err)
+			}
+			data := TemplateData{Name: u.Name, Profile: p}
+			_, err = s.RenderExtensions(spec, data)
+			for _, k := range u.Keys {
+				if err != nil {
+					break
+				}
+				_, err = s.KeyID(exampleKeyIDData(s, data, k.Label))
+			}
+			switch {
+			case err != nil && p != "":
+				return u.sourceError(fmt.Errorf("user %s profile %s %w", u.Name, p, err))
+			case err != nil:
+				return u.sourceError(fmt.Errorf("user %s %w", u.Name, err))
+			}
+		}
+	}
+	return nil
+}
+
+// override the spec with the options that are set. Critical options
+// restrict the use of a certificate, so are merged with those already
+// set rather than replacing them.
+func (spec *CertSpec) override(o CertOptions) {
+	if o.Validity != 0 {
+		spec.Validity = o.Validity
+	}
+	if o.Extensions != nil {
+		spec.Extensions = o.Extensions
+	}
+	if o.BindSourceAddress != nil {
+		spec.BindSourceAddress = o.BindSourceAddress
+	}
+	if o.KeyType != "" {
+		spec.KeyType = o.KeyType
+	}
+	if o.AccessWindows != nil {
+		spec.AccessWindows = o.AccessWindows
+	}
+	if len(o.CriticalOptions) > 0 {
+		merged := maps.Clone(spec.CriticalOptions)
+		if merged == nil {
+			merged = map[string]string{}
+		}
+		maps.Copy(merged, o.CriticalOptions)
+		spec.CriticalOptions = merged
+	}
+}
+
+// BindSource sets the source-address critical option to the network of
+// the client at remote if the spec has a source binding. If a
+// source-address is already set, the client must be within it, and the
+// binding is narrowed to the matching network if that is smaller.
+func (spec *CertSpec) BindSource(remote net.Addr) error {
+
+	b := spec.BindSourceAddress
+	if b == nil {
+		return nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return fmt.Errorf("could not parse client address %s: %w", remote, err)
+	}
+	addr := addrPort.Addr().Unmap()
+	bits := addr.BitLen()
+	if addr.Is4() && b.IPv4Prefix != 0 {
+		bits = b.IPv4Prefix
+	} else if addr.Is6() && b.IPv6Prefix != 0 {
+		bits = b.IPv6Prefix
+	}
+	bound := netip.PrefixFrom(addr, bits).Masked()
+
+	if configured, ok := spec.CriticalOptions["source-address"]; ok {
+		prefixes, err := ParseSourceAddress(configured)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+		if i < 0 {
+			return fmt.Errorf("client address %s not within source-address %s", addr, configured)
+		}
+		if prefixes[i].Bits() > bound.Bits() {
+			bound = prefixes[i]
+		}
+	}
+
+	spec.CriticalOptions = maps.Clone(spec.CriticalOptions)
+	if spec.CriticalOptions == nil {
+		spec.CriticalOptions = map[string]string{}
+	}
+	spec.CriticalOptions["source-address"] = bound.String()
+	return nil
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBindSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		binding    *SourceBinding
+		configured string
+		remote     string
+		want       string
+		err        string
+	}{
+		{"off", nil, "", "192.0.2.10:5000", "", ""},
+		{"host", &SourceBinding{}, "", "192.0.2.10:5000", "192.0.2.10/32", ""},
+		{"ipv4 prefix", &SourceBinding{IPv4Prefix: 24}, "", "192.0.2.10:5000", "192.0.2.0/24", ""},
+		{"ipv6 host", &SourceBinding{IPv4Prefix: 24}, "", "[2001:db8::1]:5000", "2001:db8::1/128", ""},
+		{"ipv6 prefix", &SourceBinding{IPv6Prefix: 64}, "", "[2001:db8::1]:5000", "2001:db8::/64", ""},
+		{"mapped ipv4", &SourceBinding{IPv4Prefix: 24}, "", "[::ffff:192.0.2.10]:5000", "192.0.2.0/24", ""},
+		{"within configured", &SourceBinding{IPv4Prefix: 24}, "10.0.0.0/8,192.0.0.0/16", "192.0.2.10:5000", "192.0.2.0/24", ""},
+		{"narrowed to configured", &SourceBinding{IPv4Prefix: 16}, "10.0.0.0/8,192.0.2.0/24", "192.0.2.10:5000", "192.0.2.0/24", ""},
+		{"outside configured", &SourceBinding{}, "10.0.0.0/8", "192.0.2.10:5000", "", "client address 192.0.2.10 not within source-address 10.0.0.0/8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &CertSpec{BindSourceAddress: tt.binding}
+			if tt.configured != "" {
+				spec.CriticalOptions = map[string]string{"source-address": tt.configured}
+			}
+			remote, err := net.ResolveTCPAddr("tcp", tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = spec.BindSource(remote)
+			if !ErrorContains(err, tt.err) {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.configured
+			}
+			if got := spec.CriticalOptions["source-address"]; got != want {
+				t.Errorf("got source-address %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestBindSourceValidate(t *testing.T) {
+	tests := []struct {
+		binding *SourceBinding
+		err     string
+	}{
+		{&SourceBinding{IPv4Prefix: 24, IPv6Prefix: 64}, ""},
+		{&SourceBinding{IPv4Prefix: 33}, "user jane bind_source_address ipv4_prefix 33 must be from 0 to 32"},
+		{&SourceBinding{IPv6Prefix: -1}, "user jane bind_source_address ipv6_prefix -1 must be from 0 to 128"},
+	}
+	for _, tt := range tests {
+		settings, err := SettingsLoad("testdata/settings_options.yaml")
+		if err != nil {
+			t.Fatalf("Could not parse yaml %v", err)
+		}
+		if got := settings.Users[1].BindSourceAddress; got == nil || *got != (SourceBinding{IPv4Prefix: 24, IPv6Prefix: 64}) {
+			t.Fatalf("bind_source_address not parsed: %v", got)
+		}
+		settings.Users[0].BindSourceAddress = tt.binding
+		err = settings.validate()
+		if !ErrorContains(err, tt.err) {
+			t.Errorf("Unexpected error %v, want %q", err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// CustomExtension is a vendor certificate extension in name@domain
+// form, such as login@github.com, which may be set in extensions with a
+// non-empty value. Values may be templates such as "{{.Name}}" and,
+// once rendered, must match all of Pattern if set.
+type CustomExtension struct {
+	Pattern string `yaml:"pattern"`
+	re      *regexp.Regexp
+}
+
+// isVendorExtension reports if name has the name@domain form of a
+// vendor extension
+func isVendorExtension(name string) bool {
+	local, domain, ok := strings.Cut(name, "@")
+	return ok && local != "" && domain != "" && !strings.ContainsAny(domain, "@ ")
+}
+
+// validateCustomExtensions checks the custom extension names and
+// compiles their value patterns
+func (s *Settings) validateCustomExtensions() error {
+	for _, name := range slices.Sorted(maps.Keys(s.CustomExtensions)) {
+		if !isVendorExtension(name) {
+			return fmt.Errorf("custom extension %s must be in name@domain form", name)
+		}
+		if _, ok := permittedExtensions[name]; ok {
+			return fmt.Errorf("custom extension %s is a standard extension", name)
+		}
+		ce := s.CustomExtensions[name]
+		if ce == nil {
+			ce = &CustomExtension{}
+			s.CustomExtensions[name] = ce
+		}
+		if ce.Pattern == "" {
+			continue
+		}
+		if _, err := regexp.Compile(ce.Pattern); err != nil {
+			return fmt.Errorf("custom extension %s pattern: %w", name, err)
+		}
+		ce.re = regexp.MustCompile("^(?:" + ce.Pattern + ")$")
+	}
+	return nil
+}
+
+// checkCustomExtensions checks the custom extensions in extensions are
+// in the custom_extensions list
+func (s *Settings) checkCustomExtensions(extensions map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(extensions)) {
+		if _, ok := permittedExtensions[name]; ok {
+			continue
+		}
+		if _, ok := s.CustomExtensions[name]; !ok {
+			return fmt.Errorf("extension %s not in custom_extensions", name)
+		}
+	}
+	return nil
+}
+
+// RenderExtensions returns the extensions of spec, with the values of
+// custom extensions rendered with data and checked against their
+// patterns
+func (s *Settings) RenderExtensions(spec *CertSpec, data TemplateData) (map[string]string, error) {
+	if err := s.checkCustomExtensions(spec.Extensions); err != nil {
+		return nil, err
+	}
+	extensions := maps.Clone(spec.Extensions)
+	for name, value := range spec.Extensions {
+		ce, ok := s.CustomExtensions[name]
+		if !ok {
+			continue
+		}
+		rendered, err := renderTemplate(value, data)
+		if err != nil {
+			return nil, fmt.Errorf("extension %s value: %w", name, err)
+		}
+		if ce.re != nil && !ce.re.MatchString(rendered) {
+			return nil, fmt.Errorf("extension %s value %q does not match pattern %s", name, rendered, ce.Pattern)
+		}
+		extensions[name] = rendered
+	}
+	return extensions, nil
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestCustomExtensions(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_extensions.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	alice := settings.Users[0]
+
+	tests := []struct {
+		profile    string
+		extensions map[string]string
+	}{
+		{"", map[string]string{"permit-pty": "", "login@github.com": "alice"}},
+		{"admin", map[string]string{"login@github.com": "alice-admin", "sudo@example.com": "all"}},
+	}
+	for _, tt := range tests {
+		spec, err := settings.CertSpec(alice, tt.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := settings.RenderExtensions(spec, TemplateData{Name: alice.Name, Profile: tt.profile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(got, tt.extensions) {
+			t.Errorf("profile %q got extensions %v want %v", tt.profile, got, tt.extensions)
+		}
+	}
+}
+
+func TestCustomExtensionsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(s *Settings)
+		err    string
+	}{
+		{"not listed", func(s *Settings) { s.Extensions["other@example.com"] = "x" }, "extension other@example.com not in custom_extensions"},
+		{"not vendor form", func(s *Settings) { s.CustomExtensions["nodomain"] = nil }, "custom extension nodomain must be in name@domain form"},
+		{"standard name", func(s *Settings) { s.Extensions["permit-pty"] = "x" }, "value"},
+		{"bad pattern", func(s *Settings) { s.CustomExtensions["login@github.com"].Pattern = "[" }, "custom extension login@github.com pattern"},
+		{"bad template", func(s *Settings) { s.Extensions["login@github.com"] = "{{.Name" }, "extension login@github.com value"},
+		{"unknown field", func(s *Settings) { s.Extensions["login@github.com"] = "{{.Email}}" }, "user alice extension login@github.com value"},
+		{"value mismatch", func(s *Settings) { s.Users[0].Name = "alice smith" }, `user alice smith extension login@github.com value "alice smith" does not match pattern`},
+		{"profile value mismatch", func(s *Settings) {
+			s.Users[0].Profiles["admin"].Extensions["login@github.com"] = "{{.Profile}}!"
+		}, "user alice profile admin extension login@github.com value"},
+		{"user not listed", func(s *Settings) { s.Users[0].Extensions = map[string]string{"x@y": ""} }, "user alice extension x@y not in custom_extensions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := SettingsLoad("testdata/settings_extensions.yaml")
+			if err != nil {
+				t.Fatalf("Could not parse yaml %v", err)
+			}
+			tt.mangle(&settings)
+			err = settings.validate()
+			t.Log(err)
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Group is a named set of principals and certificate settings shared by
+// the users listing the group in their groups. Groups may include other
+// groups, although not cyclically.
+type Group struct {
+	Principals  []string `yaml:"principals"`
+	Groups      []string `yaml:"groups"`
+	CertOptions `yaml:",inline"`
+	name        string
+}
+
+// resolveGroups returns the groups named, followed depth first by the
+// groups they include, with each group only listed once. The groups
+// are not modified.
+func (s *Settings) resolveGroups(names []string) ([]*Group, error) {
+	resolved := []*Group{}
+	seen := map[string]bool{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if slices.Contains(path, name) {
+			return fmt.Errorf("group cycle %v", append(path, name))
+		}
+		g, ok := s.Groups[name]
+		if !ok {
+			return fmt.Errorf("unknown group %s", name)
+		}
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		resolved = append(resolved, g)
+		for _, n := range g.Groups {
+			if err := visit(n, append(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, n := range names {
+		if err := visit(n, nil); err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
+
+// validateGroups names each group, then checks each group's settings
+// and that groups do not include unknown groups or form cycles. Groups
+// are named here, when the settings are loaded, as settings are read
+// concurrently by connections once loaded.
+func (s *Settings) validateGroups() error {
+	for name, g := range s.Groups {
+		if g != nil {
+			g.name = name
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Groups)) {
+		g := s.Groups[name]
+		if name == "" {
+			return errors.New("group provided with empty name")
+		}
+		if g == nil {
+			return fmt.Errorf("group %s is empty", name)
+		}
+		if err := g.CertOptions.validate(); err != nil {
+			return fmt.Errorf("group %s %w", name, err)
+		}
+		if err := s.validateWindowNames(g.AccessWindows); err != nil {
+			return fmt.Errorf("group %s %w", name, err)
+		}
+		if err := s.checkCustomExtensions(g.Extensions); err != nil {
+			return fmt.Errorf("group %s %w", name, err)
+		}
+		if _, err := s.resolveGroups([]string{name}); err != nil {
+			return fmt.Errorf("group %s %w", name, err)
+		}
+	}
+	return nil
+}
+
+// PrincipalsFor returns the principals of the user and their groups,
+// before templates are rendered, without duplicates
+func (s *Settings) PrincipalsFor(user *UserPrincipals) ([]string, error) {
+	groups, err := s.resolveGroups(user.Groups)
+	if err != nil {
+		return nil, fmt.Errorf("user %s %w", user.Name, err)
+	}
+	principals := slices.Clone(user.Principals)
+	for _, g := range groups {
+		for _, p := range g.Principals {
+			if !slices.Contains(principals, p) {
+				principals = append(principals, p)
+			}
+		}
+	}
+	return principals, nil
+}
+
+// applyGroups applies the certificate options of the groups to spec.
+// The shortest group validity and the first group key type are used;
+// group extensions, critical options and access windows are combined.
+func (spec *CertSpec) applyGroups(groups []*Group) {
+	var validity uint32
+	var extensions map[string]string
+	var keyType string
+	for _, g := range groups {
+		if g.Validity != 0 && (validity == 0 || g.Validity < validity) {
+			validity = g.Validity
+		}
+		if g.Extensions != nil {
+			if extensions == nil {
+				extensions = map[string]string{}
+			}
+			maps.Copy(extensions, g.Extensions)
+		}
+		if g.BindSourceAddress != nil && spec.BindSourceAddress == nil {
+			spec.BindSourceAddress = g.BindSourceAddress
+		}
+		if g.KeyType != "" && keyType == "" {
+			keyType = g.KeyType
+		}
+		spec.override(CertOptions{CriticalOptions: g.CriticalOptions})
+	}
+	spec.override(CertOptions{Validity: validity, Extensions: extensions, KeyType: keyType})
+	spec.applyGroupWindows(groups)
+}
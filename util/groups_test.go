@@ -0,0 +1,148 @@
+package util
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_groups.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	bob, bill := settings.Users[0], settings.Users[1]
+
+	// nested groups are resolved, shortest validity and combined
+	// extensions used
+	spec, err := settings.CertSpec(bob, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"root", "database", "web"}; !slices.Equal(spec.Principals, want) {
+		t.Errorf("got principals %v want %v", spec.Principals, want)
+	}
+	if spec.Validity != 30 {
+		t.Errorf("got validity %d want 30", spec.Validity)
+	}
+	wantExt := map[string]string{"permit-agent-forwarding": "", "permit-port-forwarding": ""}
+	if !maps.Equal(spec.Extensions, wantExt) {
+		t.Errorf("got extensions %v want %v", spec.Extensions, wantExt)
+	}
+
+	// user settings override group settings
+	spec, err = settings.CertSpec(bill, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bill", "web"}; !slices.Equal(spec.Principals, want) {
+		t.Errorf("got principals %v want %v", spec.Principals, want)
+	}
+	if spec.Validity != 90 {
+		t.Errorf("got validity %d want 90", spec.Validity)
+	}
+	if !maps.Equal(spec.Extensions, settings.Extensions) {
+		t.Errorf("got extensions %v want global extensions", spec.Extensions)
+	}
+}
+
+func TestGroupsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(s *Settings)
+		err    string
+	}{
+		{"valid", func(s *Settings) {}, ""},
+		{"unknown user group", func(s *Settings) {
+			s.Users[0].Groups = []string{"nosuch"}
+		}, "user bob unknown group nosuch"},
+		{"unknown nested group", func(s *Settings) {
+			s.Groups["ops"].Groups = []string{"nosuch"}
+		}, "unknown group nosuch"},
+		{"cycle", func(s *Settings) {
+			s.Groups["web"].Groups = []string{"oncall"}
+		}, "group cycle [oncall ops web oncall]"},
+		{"self cycle", func(s *Settings) {
+			s.Groups["web"].Groups = []string{"web"}
+		}, "group cycle [oncall ops web web]"},
+		{"empty group", func(s *Settings) {
+			s.Groups["empty"] = nil
+		}, "group empty is empty"},
+		{"group validity", func(s *Settings) {
+			s.Groups["web"].Validity = maxmins + 1
+		}, "group web validity must be"},
+		{"group extension", func(s *Settings) {
+			s.Groups["web"].Extensions = map[string]string{"bad": ""}
+		}, "group web extension bad not permitted"},
+		{"no principals", func(s *Settings) {
+			s.Groups["oncall"].Principals = nil
+			s.Groups["oncall"].Groups = nil
+		}, "user bob provided with no principals"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := SettingsLoad("testdata/settings_groups.yaml")
+			if err != nil {
+				t.Fatalf("Could not parse yaml %v", err)
+			}
+			tt.modify(&settings)
+			err = settings.validate()
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("Unexpected error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// certificate specs are resolved concurrently by connections sharing
+// the settings, which must not be modified; run with -race
+func TestGroupsConcurrent(t *testing.T) {
+	for _, file := range []string{"testdata/settings_groups.yaml", "testdata/settings_templates.yaml"} {
+		settings, err := SettingsLoad(file)
+		if err != nil {
+			t.Fatalf("Could not parse yaml %v", err)
+		}
+		want := map[string][]string{}
+		for _, u := range settings.Users {
+			spec, err := settings.CertSpec(u, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[u.Name] = spec.Principals
+		}
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Go(func() {
+				for range 50 {
+					for _, u := range settings.Users {
+						spec, err := settings.CertSpec(u, "")
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if !slices.Equal(spec.Principals, want[u.Name]) {
+							t.Errorf("%s user %s got principals %v want %v", file, u.Name, spec.Principals, want[u.Name])
+						}
+						if _, err := settings.PrincipalsFor(u); err != nil {
+							t.Error(err)
+						}
+					}
+				}
+			})
+		}
+		wg.Wait()
+	}
+	settings, err := SettingsLoad("testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := settings.CertSpec(settings.Users[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice", "team-web", "team-dba"}; !slices.Equal(spec.Principals, want) {
+		t.Errorf("got principals %v want %v", spec.Principals, want)
+	}
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Time formats used for the validity of certificates in key ids
+const (
+	KeyIDFromFormat = "2006-01-02T15:04"
+	KeyIDToFormat   = "2006-01-02T15:04MST"
+)
+
+// NewKeyIDData returns the key id data for a certificate with the
+// validity from and to, issued for reason if one is required
+func (s *Settings) NewKeyIDData(data TemplateData, label string, serial uint64, from, to time.Time, reason string) KeyIDData {
+	return KeyIDData{
+		TemplateData: data,
+		Organisation: s.Organisation,
+		Label:        label,
+		Serial:       serial,
+		From:         from.Format(KeyIDFromFormat),
+		To:           to.Format(KeyIDToFormat),
+		Reason:       reason,
+	}
+}
+
+// KeyID returns the key id of a certificate, rendered from the key_id
+// template if set. Otherwise the key id is in the form
+// org_name[_label][_profile]_from:<from>_to:<to>[_reason:<reason>].
+func (s *Settings) KeyID(data KeyIDData) (string, error) {
+	if s.KeyIDTemplate == "" {
+		id := fmt.Sprintf("%s_%s", data.Organisation, data.Name)
+		if data.Label != "" {
+			id = fmt.Sprintf("%s_%s", id, data.Label)
+		}
+		if data.Profile != "" {
+			id = fmt.Sprintf("%s_%s", id, data.Profile)
+		}
+		id = fmt.Sprintf("%s_from:%s_to:%s", id, data.From, data.To)
+		if data.Reason != "" {
+			id = fmt.Sprintf("%s_reason:%s", id, data.Reason)
+		}
+		return id, nil
+	}
+	id, err := renderTemplate(s.KeyIDTemplate, data)
+	if err != nil {
+		return "", fmt.Errorf("key_id: %w", err)
+	}
+	if id == "" {
+		return "", errors.New("key_id renders to an empty key id")
+	}
+	return id, nil
+}
+
+// exampleKeyIDData returns key id data with an example validity,
+// serial and reason, for checking the key_id template renders
+func exampleKeyIDData(s *Settings, data TemplateData, label string) KeyIDData {
+	from := time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+	return s.NewKeyIDData(data, label, 1, from, from.Add(time.Duration(s.Validity)*time.Minute), reasonCheck)
+}
+
+// validateKeyID checks the key_id template parses and renders, and
+// that it includes the reason if any profile requires a reason
+func (s *Settings) validateKeyID() error {
+	if s.KeyIDTemplate == "" {
+		return nil
+	}
+	if _, err := parseTemplate(s.KeyIDTemplate); err != nil {
+		return fmt.Errorf("key_id: %w", err)
+	}
+	id, err := s.KeyID(exampleKeyIDData(s, TemplateData{Name: "user"}, ""))
+	if err != nil {
+		return err
+	}
+	if s.requiresReason() && !strings.Contains(id, reasonCheck) {
+		return errors.New("key_id must include {{.Reason}} as profiles require a reason")
+	}
+	return nil
+}
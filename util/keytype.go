@@ -0,0 +1,80 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultKeyType is the type of key generated for certificates if no
+// key_type is set
+const DefaultKeyType = "ed25519"
+
+// keyGenerators generate the private keys for each key_type, which
+// are suitable for adding to an ssh agent
+var keyGenerators = map[string]func() (crypto.Signer, error){
+	"ed25519": func() (crypto.Signer, error) {
+		_, pvt, err := ed25519.GenerateKey(rand.Reader)
+		return pvt, err
+	},
+	"ecdsa-p256": func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	},
+	"ecdsa-p384": func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	},
+	"rsa-3072": func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 3072)
+	},
+	"rsa-4096": func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 4096)
+	},
+}
+
+// KeyTypes returns the key types which may be generated, in order
+func KeyTypes() []string {
+	types := []string{}
+	for t := range keyGenerators {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// validateKeyType checks the key type may be generated; an empty key
+// type uses the default
+func validateKeyType(keyType string) error {
+	if _, ok := keyGenerators[keyType]; !ok && keyType != "" {
+		return fmt.Errorf("key_type %s not supported, use one of %s", keyType, strings.Join(KeyTypes(), ", "))
+	}
+	return nil
+}
+
+// GenerateKey generates a private key of keyType, or the default key
+// type if empty, returning the private key and its ssh public key
+func GenerateKey(keyType string) (crypto.Signer, ssh.PublicKey, error) {
+	if keyType == "" {
+		keyType = DefaultKeyType
+	}
+	generate, ok := keyGenerators[keyType]
+	if !ok {
+		return nil, nil, fmt.Errorf("key_type %s not supported", keyType)
+	}
+	pvt, err := generate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate %s key: %w", keyType, err)
+	}
+	pub, err := ssh.NewPublicKey(pvt.Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert %s public key to ssh key: %w", keyType, err)
+	}
+	return pvt, pub, nil
+}
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Revocation records the revocation of certificates by serial number,
+// key id or the fingerprint of the user key used to obtain them. Only
+// one of Serial, KeyID or Fingerprint is set. Revocations are stored in
+// the revocations file as json lines.
+type Revocation struct {
+	Time        time.Time `json:"time"`
+	Serial      uint64    `json:"serial,omitempty"`
+	KeyID       string    `json:"key_id,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// RecordRevocation appends a revocation to the revocations file at path
+func RecordRevocation(path string, r Revocation) error {
+	return appendJSONLine(path, r)
+}
+
+// ReadRevocations reads all the revocations in the file at path
+func ReadRevocations(path string) ([]Revocation, error) {
+	return readJSONLines[Revocation](path)
+}
+
+// KRL is an OpenSSH key revocation list revoking certificates signed
+// by a single certificate authority, suitable for use with the sshd
+// RevokedKeys setting. See PROTOCOL.krl in the OpenSSH distribution.
+type KRL struct {
+	CA        ssh.PublicKey
+	Serials   []uint64
+	KeyIDs    []string
+	Comment   string
+	Generated time.Time
+}
+
+// KRL format constants from PROTOCOL.krl
+const (
+	krlMagic              uint64 = 0x5353484b524c0a00
+	krlFormatVersion      uint32 = 1
+	krlSectionCerts       byte   = 1
+	krlSectionSerialList  byte   = 0x20
+	krlSectionCertKeyID   byte   = 0x23
+	krlMaxSerialListBytes        = 1 << 16
+)
+
+// BuildKRL builds a KRL for certificates signed by ca from the
+// revocations, using the ledger to find the serials of certificates
+// issued to revoked user key fingerprints
+func BuildKRL(ca ssh.PublicKey, entries []LedgerEntry, revocations []Revocation) *KRL {
+
+	serials := map[uint64]bool{}
+	keyIDs := map[string]bool{}
+	for _, r := range revocations {
+		switch {
+		case r.Serial != 0:
+			serials[r.Serial] = true
+		case r.KeyID != "":
+			keyIDs[r.KeyID] = true
+		case r.Fingerprint != "":
+			for _, e := range entries {
+				if e.Fingerprint == r.Fingerprint && e.Serial != 0 {
+					serials[e.Serial] = true
+				}
+			}
+		}
+	}
+
+	k := &KRL{CA: ca, Generated: time.Now().UTC()}
+	for s := range serials {
+		k.Serials = append(k.Serials, s)
+	}
+	for id := range keyIDs {
+		k.KeyIDs = append(k.KeyIDs, id)
+	}
+	slices.Sort(k.Serials)
+	slices.Sort(k.KeyIDs)
+	return k
+}
+
+// krlBuffer writes the big-endian wire types used in KRLs
+type krlBuffer []byte
+
+func (b *krlBuffer) byte(v byte)     { *b = append(*b, v) }
+func (b *krlBuffer) uint32(v uint32) { *b = binary.BigEndian.AppendUint32(*b, v) }
+func (b *krlBuffer) uint64(v uint64) { *b = binary.BigEndian.AppendUint64(*b, v) }
+func (b *krlBuffer) string(v []byte) {
+	b.uint32(uint32(len(v)))
+	*b = append(*b, v...)
+}
+
+// Marshal encodes the KRL in OpenSSH binary format. The KRL version is
+// the generation time, so that later KRLs have higher versions.
+func (k *KRL) Marshal() []byte {
+
+	var certs krlBuffer
+	certs.string(k.CA.Marshal())
+	certs.string(nil) // reserved
+
+	// serials must be in ascending order; split long lists into
+	// several sections
+	for s := k.Serials; len(s) > 0; {
+		n := min(len(s), krlMaxSerialListBytes/8)
+		var list krlBuffer
+		for _, serial := range s[:n] {
+			list.uint64(serial)
+		}
+		certs.byte(krlSectionSerialList)
+		certs.string(list)
+		s = s[n:]
+	}
+	if len(k.KeyIDs) > 0 {
+		var ids krlBuffer
+		for _, id := range k.KeyIDs {
+			ids.string([]byte(id))
+		}
+		certs.byte(krlSectionCertKeyID)
+		certs.string(ids)
+	}
+
+	var b krlBuffer
+	b.uint64(krlMagic)
+	b.uint32(krlFormatVersion)
+	b.uint64(uint64(k.Generated.Unix()))
+	b.uint64(uint64(k.Generated.Unix()))
+	b.uint64(0)   // flags
+	b.string(nil) // reserved
+	b.string([]byte(k.Comment))
+	b.byte(krlSectionCerts)
+	b.string(certs)
+	return b
+}
+
+// WriteFile atomically writes the KRL to path
+func (k *KRL) WriteFile(path string) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(k.Marshal()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not write krl: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newKRLTestSigner makes an ed25519 signer
+func newKRLTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, pvt, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(pvt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeTestCert signs a user certificate with ca and writes it to dir,
+// returning the file name
+func writeTestCert(t *testing.T, dir string, ca ssh.Signer, serial uint64, keyID string) string {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             newKRLTestSigner(t).PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{"web"},
+		ValidAfter:      uint64(time.Now().Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, keyID+"-cert.pub")
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// query the krl with ssh-keygen -Q, which exits with status 1 and
+// reports REVOKED for revoked keys
+func krlQuery(t *testing.T, krlPath, certPath string) bool {
+	t.Helper()
+	out, err := exec.Command("ssh-keygen", "-Q", "-f", krlPath, certPath).CombinedOutput()
+	revoked := strings.Contains(string(out), "REVOKED")
+	if err == nil && revoked || err != nil && !revoked {
+		t.Fatalf("unexpected ssh-keygen result %q (%v)", out, err)
+	}
+	return revoked
+}
+
+func TestKRLSSHKeygen(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir := t.TempDir()
+	ca := newKRLTestSigner(t)
+	otherCA := newKRLTestSigner(t)
+
+	ledger := []LedgerEntry{
+		{Serial: 10, Fingerprint: "SHA256:jane"},
+		{Serial: 11, Fingerprint: "SHA256:john"},
+		{Serial: 12, Fingerprint: "SHA256:jane"},
+	}
+	revocations := []Revocation{
+		{Serial: 3},
+		{Serial: 1},
+		{Serial: 3},
+		{KeyID: "acmeinc_bill"},
+		{Fingerprint: "SHA256:jane"},
+	}
+	krl := BuildKRL(ca.PublicKey(), ledger, revocations)
+	krl.Comment = "test krl"
+	if want := []uint64{1, 3, 10, 12}; !slices.Equal(krl.Serials, want) {
+		t.Errorf("got serials %v want %v", krl.Serials, want)
+	}
+	krlPath := filepath.Join(dir, "krl")
+	if err := krl.WriteFile(krlPath); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ca      ssh.Signer
+		serial  uint64
+		keyID   string
+		revoked bool
+	}{
+		{"serial", ca, 1, "acmeinc_a", true},
+		{"second serial", ca, 3, "acmeinc_b", true},
+		{"unrevoked serial", ca, 2, "acmeinc_c", false},
+		{"key id", ca, 4, "acmeinc_bill", true},
+		{"fingerprint from ledger", ca, 12, "acmeinc_d", true},
+		{"other user in ledger", ca, 11, "acmeinc_e", false},
+		{"other ca", otherCA, 1, "acmeinc_f", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certPath := writeTestCert(t, dir, tt.ca, tt.serial, tt.keyID)
+			if got := krlQuery(t, krlPath, certPath); got != tt.revoked {
+				t.Errorf("certificate serial %d key id %s revoked %t want %t", tt.serial, tt.keyID, got, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestKRLEmpty(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir := t.TempDir()
+	ca := newKRLTestSigner(t)
+	krlPath := filepath.Join(dir, "krl")
+	if err := BuildKRL(ca.PublicKey(), nil, nil).WriteFile(krlPath); err != nil {
+		t.Fatal(err)
+	}
+	if krlQuery(t, krlPath, writeTestCert(t, dir, ca, 1, "acmeinc_a")) {
+		t.Error("certificate revoked by empty krl")
+	}
+}
+
+func TestRevocationsRecordRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	for _, r := range []Revocation{{Serial: 1, Reason: "lost laptop"}, {KeyID: "x"}} {
+		if err := RecordRevocation(path, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revocations, err := ReadRevocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 2 || revocations[0].Reason != "lost laptop" || revocations[1].KeyID != "x" {
+		t.Errorf("unexpected revocations %+v", revocations)
+	}
+}
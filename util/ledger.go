@@ -0,0 +1,200 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// LedgerEntry records a certificate issued by sshagentca. Entries are
+// stored in the ledger file as json lines.
+type LedgerEntry struct {
+	Serial          uint64            `json:"serial"`
+	KeyID           string            `json:"key_id"`
+	Issued          time.Time         `json:"issued"`
+	User            string            `json:"user"`
+	Fingerprint     string            `json:"fingerprint"`
+	KeyLabel        string            `json:"key_label,omitempty"`
+	Profile         string            `json:"profile,omitempty"`
+	Reason          string            `json:"reason,omitempty"`
+	ApprovedBy      string            `json:"approved_by,omitempty"`
+	Principals      []string          `json:"principals"`
+	ValidAfter      time.Time         `json:"valid_after"`
+	ValidBefore     time.Time         `json:"valid_before"`
+	Extensions      map[string]string `json:"extensions"`
+	CriticalOptions map[string]string `json:"critical_options,omitempty"`
+	RemoteAddr      string            `json:"remote_addr"`
+	ClientVersion   string            `json:"client_version"`
+}
+
+// Ledger is an append-only record of issued certificates
+type Ledger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenLedger opens the ledger file at path for appending, creating it
+// if necessary. A final line without a newline, as may be left by a
+// crash during writing, is removed so that entries are appended after
+// the last complete line.
+func OpenLedger(path string) (*Ledger, error) {
+	f, err := openJSONLines(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Ledger{file: f}, nil
+}
+
+// Record appends an entry to the ledger, syncing it to disk before
+// returning. It is safe for concurrent use.
+func (l *Ledger) Record(e LedgerEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err = l.file.Write(line); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Close closes the ledger file
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// ReadLedger reads all the entries in the ledger file at path. A final
+// line without a newline, as may be left by a crash during writing, is
+// ignored, and removed when the ledger is next opened.
+func ReadLedger(path string) ([]LedgerEntry, error) {
+	return readJSONLines[LedgerEntry](path)
+}
+
+// openJSONLines opens a file of json lines at path for appending,
+// creating it if necessary, and removes a final line without a newline
+func openJSONLines(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := trimTornLine(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// trimTornLine truncates f after its last newline, removing a partially
+// written final line
+func trimTornLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	for end := info.Size(); end > 0; {
+		n := min(int64(len(buf)), end)
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			last := end - n + int64(i) + 1
+			if last == info.Size() {
+				return nil
+			}
+			return f.Truncate(last)
+		}
+		end -= n
+	}
+	return f.Truncate(0)
+}
+
+// appendJSONLine appends v as a json line to the file at path, creating
+// the file if necessary
+func appendJSONLine(path string, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := openJSONLines(path)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readJSONLines reads a file of json lines into a slice of T, ignoring
+// a final line without a newline
+func readJSONLines[T any](path string) ([]T, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []T{}
+	reader := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var r T
+		if err := json.Unmarshal(line, &r); err != nil {
+			return records, fmt.Errorf("%s line %d: %w", path, lineNo, err)
+		}
+		records = append(records, r)
+	}
+}
+
+// LedgerFilter selects ledger entries. Empty fields match all entries.
+type LedgerFilter struct {
+	User      string
+	Principal string
+	From      time.Time // issued at or after
+	To        time.Time // issued before
+}
+
+// Match reports if the entry is selected by the filter
+func (f LedgerFilter) Match(e LedgerEntry) bool {
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Principal != "" && !slices.Contains(e.Principals, f.Principal) {
+		return false
+	}
+	if !f.From.IsZero() && e.Issued.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Issued.Before(f.To) {
+		return false
+	}
+	return true
+}
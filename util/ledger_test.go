@@ -0,0 +1,165 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLedgerEntries() []LedgerEntry {
+	base := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	return []LedgerEntry{
+		{Serial: 1, User: "jane", Principals: []string{"web", "root"}, Issued: base},
+		{Serial: 2, User: "john", Principals: []string{"web"}, Issued: base.Add(time.Hour)},
+		{Serial: 3, User: "jane", Principals: []string{"database"}, Issued: base.Add(2 * time.Hour)},
+	}
+}
+
+func TestLedgerRecordRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger")
+	ledger, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range testLedgerEntries() {
+		if err := ledger.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening appends
+	ledger, err = OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.Record(LedgerEntry{Serial: 4, User: "bill"}); err != nil {
+		t.Fatal(err)
+	}
+	ledger.Close()
+
+	entries, err := ReadLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries want 4", len(entries))
+	}
+	for i, e := range entries {
+		if e.Serial != uint64(i+1) {
+			t.Errorf("entry %d has serial %d", i, e.Serial)
+		}
+	}
+	if !entries[0].Issued.Equal(testLedgerEntries()[0].Issued) {
+		t.Errorf("issued time not preserved: %s", entries[0].Issued)
+	}
+}
+
+// a partially written final line is ignored, but corruption elsewhere
+// is reported
+func TestLedgerReadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger")
+	contents := `{"serial":1,"user":"jane"}` + "\n" + `{"serial":2,"us`
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d entries want 1", len(entries))
+	}
+
+	contents = `{"serial":1,"us` + "\n" + `{"serial":2,"user":"jane"}` + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadLedger(path)
+	if !ErrorContains(err, "line 1") {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+// entries recorded after a partially written final line are appended
+// after the last complete line, leaving the ledger readable
+func TestLedgerRecordAfterTornWrite(t *testing.T) {
+	for _, torn := range []string{`{"serial":2,"us`, strings.Repeat("x", 5000)} {
+		path := filepath.Join(t.TempDir(), "ledger")
+		contents := `{"serial":1,"user":"jane"}` + "\n" + torn
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		ledger, err := OpenLedger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ledger.Record(LedgerEntry{Serial: 3, User: "john"}); err != nil {
+			t.Fatal(err)
+		}
+		ledger.Close()
+
+		entries, err := ReadLedger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Serial != 1 || entries[1].Serial != 3 {
+			t.Errorf("got entries %+v", entries)
+		}
+	}
+
+	// a file of only a torn line is emptied
+	path := filepath.Join(t.TempDir(), "revocations")
+	if err := os.WriteFile(path, []byte(`{"serial":2,"us`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendJSONLine(path, LedgerEntry{Serial: 4}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Serial != 4 {
+		t.Errorf("got entries %+v", entries)
+	}
+}
+
+func TestLedgerFilter(t *testing.T) {
+	base := testLedgerEntries()[0].Issued
+	tests := []struct {
+		name   string
+		filter LedgerFilter
+		want   []uint64
+	}{
+		{"all", LedgerFilter{}, []uint64{1, 2, 3}},
+		{"user", LedgerFilter{User: "jane"}, []uint64{1, 3}},
+		{"principal", LedgerFilter{Principal: "web"}, []uint64{1, 2}},
+		{"user and principal", LedgerFilter{User: "jane", Principal: "web"}, []uint64{1}},
+		{"from", LedgerFilter{From: base.Add(time.Hour)}, []uint64{2, 3}},
+		{"to", LedgerFilter{To: base.Add(time.Hour)}, []uint64{1}},
+		{"no match", LedgerFilter{User: "nobody"}, []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []uint64{}
+			for _, e := range testLedgerEntries() {
+				if tt.filter.Match(e) {
+					got = append(got, e.Serial)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxReasonLength is the maximum length of a reason in characters
+const maxReasonLength = 128
+
+// reasonCheck is a reason used to check the key id includes reasons
+const reasonCheck = "reason-check"
+
+// validateReasonPattern compiles the reason_pattern which the reasons
+// given for profiles with require_reason must wholly match
+func (s *Settings) validateReasonPattern() error {
+	s.reasonRE = nil
+	if s.ReasonPattern == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(s.ReasonPattern); err != nil {
+		return fmt.Errorf("reason_pattern: %w", err)
+	}
+	s.reasonRE = regexp.MustCompile("^(?:" + s.ReasonPattern + ")$")
+	return nil
+}
+
+// requiresReason reports if any user has a profile requiring a reason
+func (s *Settings) requiresReason() bool {
+	for _, u := range s.Users {
+		for _, p := range u.Profiles {
+			if p != nil && p.RequireReason {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckReason checks the reason given for a certificate, returning it
+// without surrounding space. Reasons must be printable text of no more
+// than maxReasonLength characters matching the reason_pattern, if set.
+func (s *Settings) CheckReason(reason string) (string, error) {
+	reason = strings.TrimSpace(reason)
+	switch {
+	case reason == "":
+		return "", errors.New("a reason is required")
+	case utf8.RuneCountInString(reason) > maxReasonLength:
+		return "", fmt.Errorf("reason longer than %d characters", maxReasonLength)
+	case strings.IndexFunc(reason, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0:
+		return "", errors.New("reason contains unprintable characters")
+	case s.reasonRE != nil && !s.reasonRE.MatchString(reason):
+		return "", fmt.Errorf("reason does not match %s", s.ReasonPattern)
+	}
+	return reason, nil
+}
@@ -0,0 +1,92 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckReason(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+
+	tests := []struct {
+		pattern string
+		reason  string
+		want    string
+		err     string
+	}{
+		{"", " fixing the database ", "fixing the database", ""},
+		{"", "  ", "", "a reason is required"},
+		{"", strings.Repeat("x", maxReasonLength+1), "", "reason longer than 128 characters"},
+		{"", "INC-1\x1b[2J", "", "reason contains unprintable characters"},
+		{"INC-[0-9]+", "INC-123", "INC-123", ""},
+		{"INC-[0-9]+", "see INC-123", "", "reason does not match INC-[0-9]+"},
+	}
+	for _, tt := range tests {
+		settings.ReasonPattern = tt.pattern
+		if err := settings.validateReasonPattern(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := settings.CheckReason(tt.reason)
+		if tt.err != "" {
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("reason %q got error %v want %s", tt.reason, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("reason %q got %q error %v", tt.reason, got, err)
+		}
+	}
+}
+
+func TestReasonKeyID(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	settings.KeyIDTemplate = ""
+	from := time.Date(2026, 3, 4, 9, 30, 0, 0, time.UTC)
+	data := settings.NewKeyIDData(TemplateData{Name: "alice", Profile: "admin"}, "", 42, from, from.Add(time.Hour), "INC-123")
+	got, err := settings.KeyID(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "acmeinc_alice_admin_from:2026-03-04T09:30_to:2026-03-04T10:30UTC_reason:INC-123"; got != want {
+		t.Errorf("got key id %q want %q", got, want)
+	}
+}
+
+func TestReasonValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(s *Settings)
+		err    string
+	}{
+		{"valid", func(s *Settings) {
+			s.Users[0].Profiles["admin"].RequireReason = true
+			s.KeyIDTemplate = "{{.Name}}:{{.Reason}}"
+		}, ""},
+		{"bad pattern", func(s *Settings) { s.ReasonPattern = "[" }, "reason_pattern: error parsing regexp"},
+		{"key id without reason", func(s *Settings) {
+			s.Users[0].Profiles["admin"].RequireReason = true
+		}, "key_id must include {{.Reason}} as profiles require a reason"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := SettingsLoad("testdata/settings_templates.yaml")
+			if err != nil {
+				t.Fatalf("Could not parse yaml %v", err)
+			}
+			tt.mangle(&settings)
+			err = settings.validate()
+			t.Log(err)
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParsePrincipals splits a list of requested principals separated by
+// commas or spaces, such as "web,db"
+func ParsePrincipals(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// ParseValidity parses a requested validity in whole minutes, given as
+// a number of minutes such as "30" or a duration such as "1h30m"
+func ParseValidity(v string) (uint32, error) {
+	v = strings.TrimSpace(v)
+	if m, err := strconv.ParseUint(v, 10, 32); err == nil {
+		if m == 0 {
+			return 0, errors.New("validity must be at least one minute")
+		}
+		return uint32(m), nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid validity %q, use minutes or a duration such as 30m", v)
+	}
+	if d < time.Minute || d%time.Minute != 0 {
+		return 0, fmt.Errorf("validity %s must be a whole number of minutes", d)
+	}
+	if d/time.Minute > time.Duration(^uint32(0)) {
+		return 0, fmt.Errorf("validity %s is too long", d)
+	}
+	return uint32(d / time.Minute), nil
+}
+
+// Restrict returns a copy of spec limited to the requested principals
+// and validity in minutes, leaving the principals or validity of the
+// spec unchanged if none are requested. Principals must be among those
+// of the spec and the validity no longer than that of the spec. Whether
+// approval is required is determined by the requested principals.
+func (s *Settings) Restrict(spec *CertSpec, principals []string, validity uint32) (*CertSpec, error) {
+	restricted := *spec
+	if len(principals) > 0 {
+		restricted.Principals = []string{}
+		for _, p := range principals {
+			if !slices.Contains(spec.Principals, p) {
+				return nil, fmt.Errorf("principal %s is not permitted, choose from %s",
+					p, strings.Join(spec.Principals, ","))
+			}
+			if !slices.Contains(restricted.Principals, p) {
+				restricted.Principals = append(restricted.Principals, p)
+			}
+		}
+		restricted.RequireApproval = s.requiresApproval(restricted.Principals)
+	}
+	if validity > spec.Validity {
+		return nil, fmt.Errorf("validity %d minutes exceeds the maximum of %d", validity, spec.Validity)
+	}
+	if validity > 0 {
+		restricted.Validity = validity
+	}
+	return &restricted, nil
+}
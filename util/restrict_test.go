@@ -0,0 +1,92 @@
+package util
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseValidity(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint32
+		err   string
+	}{
+		{value: "15", want: 15},
+		{value: "30m", want: 30},
+		{value: "1h30m", want: 90},
+		{value: "0", err: "at least one minute"},
+		{value: "30s", err: "whole number of minutes"},
+		{value: "90s", err: "whole number of minutes"},
+		{value: "-5m", err: "whole number of minutes"},
+		{value: "soon", err: "invalid validity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseValidity(tt.value)
+			if !ErrorContains(err, tt.err) {
+				t.Fatalf("got error %v want %q", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d want %d", got, tt.want)
+			}
+		})
+	}
+	if got := ParsePrincipals(" web, db ,,ops "); !slices.Equal(got, []string{"web", "db", "ops"}) {
+		t.Errorf("got principals %v", got)
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	settings.Approval = &Approval{Principals: []string{"ALICE"}, Approvers: []string{"alice"}}
+	spec, err := settings.CertSpec(settings.Users[0], "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		principals []string
+		validity   uint32
+		want       []string
+		approval   bool
+		err        string
+	}{
+		{name: "unrestricted", want: []string{"alice-admin", "ALICE"}, approval: true},
+		{name: "subset", principals: []string{"alice-admin", "alice-admin"}, validity: 15, want: []string{"alice-admin"}},
+		{name: "approval", principals: []string{"ALICE"}, want: []string{"ALICE"}, approval: true},
+		{name: "maximum validity", validity: 60, want: []string{"alice-admin", "ALICE"}, approval: true},
+		{name: "not permitted", principals: []string{"root"}, err: "principal root is not permitted"},
+		{name: "too long", validity: 61, err: "validity 61 minutes exceeds the maximum of 60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := settings.Restrict(spec, tt.principals, tt.validity)
+			if !ErrorContains(err, tt.err) {
+				t.Fatalf("got error %v want %q", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(got.Principals, tt.want) {
+				t.Errorf("got principals %v want %v", got.Principals, tt.want)
+			}
+			want := tt.validity
+			if want == 0 {
+				want = spec.Validity
+			}
+			if got.Validity != want {
+				t.Errorf("got validity %d want %d", got.Validity, want)
+			}
+			if got.RequireApproval != tt.approval {
+				t.Errorf("got require approval %t", got.RequireApproval)
+			}
+		})
+	}
+	if len(spec.Principals) != 2 || spec.Validity != 60 {
+		t.Errorf("spec changed to %v %d", spec.Principals, spec.Validity)
+	}
+}
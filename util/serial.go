@@ -0,0 +1,94 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SerialAllocator allocates certificate serial numbers from a
+// monotonic counter persisted to a file. Each serial number is written
+// to disk before it is returned, so serials are not reused after a
+// crash or restart, although a crash may cause a serial to be skipped.
+// Serial numbers start at 1 since OpenSSH key revocation lists do not
+// support revoking serial 0.
+type SerialAllocator struct {
+	mu   sync.Mutex
+	path string
+	last uint64
+}
+
+// NewSerialAllocator makes a SerialAllocator persisted at path, which
+// is created on the first allocation if it does not exist
+func NewSerialAllocator(path string) (*SerialAllocator, error) {
+
+	a := &SerialAllocator{path: path}
+
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	a.last, err = strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("serial file %s is corrupt: %w", path, err)
+	}
+	return a, nil
+}
+
+// Next allocates the next serial number. It is safe for concurrent use.
+func (a *SerialAllocator) Next() (uint64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.last == ^uint64(0) {
+		return 0, errors.New("serial numbers exhausted")
+	}
+	next := a.last + 1
+	if err := a.persist(next); err != nil {
+		return 0, fmt.Errorf("could not save serial: %w", err)
+	}
+	a.last = next
+	return next, nil
+}
+
+// persist atomically replaces the serial file by writing to a temporary
+// file in the same directory, syncing it and renaming it into place
+func (a *SerialAllocator) persist(serial uint64) error {
+
+	dir := filepath.Dir(a.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(a.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.WriteString(strconv.FormatUint(serial, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), a.path); err != nil {
+		return err
+	}
+
+	// sync the directory so the rename survives a crash
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSerialAllocator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial")
+
+	a, err := NewSerialAllocator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := uint64(1); want <= 3; want++ {
+		got, err := a.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got serial %d want %d", got, want)
+		}
+	}
+
+	// a new allocator continues from the persisted serial
+	a, err = NewSerialAllocator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 4 {
+		t.Errorf("got serial %d after reopening, want 4", got)
+	}
+}
+
+func TestSerialAllocatorConcurrent(t *testing.T) {
+	a, err := NewSerialAllocator(filepath.Join(t.TempDir(), "serial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, each = 8, 20
+	var mu sync.Mutex
+	seen := map[uint64]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				s, err := a.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[s] {
+					t.Errorf("serial %d allocated twice", s)
+				}
+				seen[s] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != workers*each {
+		t.Errorf("got %d serials want %d", len(seen), workers*each)
+	}
+}
+
+func TestSerialAllocatorCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial")
+	if err := os.WriteFile(path, []byte("not a number"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewSerialAllocator(path)
+	if !ErrorContains(err, "is corrupt") {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -3,7 +3,14 @@ package util
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"net/netip"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	yaml "gopkg.in/yaml.v3"
@@ -24,16 +31,145 @@ var permittedExtensions = map[string]string{
 	"permit-user-rc":          "",
 }
 
+// Restrict the certificate critical options to those defined for user
+// certificates at the PROTOCOL.certkeys url above. Each takes a
+// non-empty value.
+var permittedCriticalOptions = map[string]bool{
+	"force-command":  true,
+	"source-address": true,
+}
+
 // UserPrincipals are configured in the yaml settings file to have
 // certificates created for the stated Principals given access to the
-// sshagentca server with SSHPublicKey. SSH Key fingerprints are used
-// for lookups as these are more convenient for logging. See
+// sshagentca server with any of the user's Keys. SSH Key fingerprints
+// are used for lookups as these are more convenient for logging. See
 // settings.example.yaml for the example settings file.
 type UserPrincipals struct {
-	Name        string
-	Principals  []string
+	Name       string
+	Principals []string
+	Keys       []*UserKey
+	Groups     []string
+	Profiles   map[string]*Profile
+	ValidFrom  time.Time // zero if unset
+	ValidUntil time.Time // zero if unset
+	// SignUserKey certifies the key the user authenticated with rather
+	// than a new key added to their agent
+	SignUserKey bool
+	CertOptions
+	file string // settings file defining the user
+	line int
+}
+
+// Source reports the file and line at which the user is defined
+func (up *UserPrincipals) Source() string {
+	return fmt.Sprintf("%s:%d", up.file, up.line)
+}
+
+// sourceError prefixes err with the source of the user, if known
+func (up *UserPrincipals) sourceError(err error) error {
+	if up.file == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", up.Source(), err)
+}
+
+// UserKey is one of a user's public keys, with an optional Label, such
+// as "laptop" or "token", identifying the key in logs and certificate
+// key ids
+type UserKey struct {
 	PublicKey   ssh.PublicKey
 	Fingerprint string
+	Label       string
+}
+
+// ActiveAt reports an error if the user's account is not valid at t
+// because it is before the user's ValidFrom or at or after their
+// ValidUntil time
+func (up *UserPrincipals) ActiveAt(t time.Time) error {
+	if !up.ValidFrom.IsZero() && t.Before(up.ValidFrom) {
+		return fmt.Errorf("user %s account not valid until %s", up.Name, up.ValidFrom.Format(time.RFC3339))
+	}
+	if !up.ValidUntil.IsZero() && !t.Before(up.ValidUntil) {
+		return fmt.Errorf("user %s account expired at %s", up.Name, up.ValidUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CapValidBefore limits the end of a certificate's validity to the
+// user's ValidUntil time, if set, so that a certificate does not
+// outlive the user's account
+func (up *UserPrincipals) CapValidBefore(validBefore time.Time) time.Time {
+	if !up.ValidUntil.IsZero() && validBefore.After(up.ValidUntil) {
+		return up.ValidUntil
+	}
+	return validBefore
+}
+
+// String describes the key by fingerprint and label for logging
+func (k *UserKey) String() string {
+	if k.Label == "" {
+		return k.Fingerprint
+	}
+	return fmt.Sprintf("%s (%s)", k.Fingerprint, k.Label)
+}
+
+// Key returns the user's key with the fingerprint fp, or nil
+func (up *UserPrincipals) Key(fp string) *UserKey {
+	for _, k := range up.Keys {
+		if k.Fingerprint == fp {
+			return k
+		}
+	}
+	return nil
+}
+
+// auxUserKey is an entry in a user's sshpublickeys list, which is
+// either an authorized key string or a mapping with a key and label
+type auxUserKey struct {
+	Key   string `yaml:"key"`
+	Label string `yaml:"label"`
+}
+
+// UnmarshalYAML unmarshals a key string or key and label mapping
+func (ak *auxUserKey) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&ak.Key)
+	}
+	type plain auxUserKey
+	return value.Decode((*plain)(ak))
+}
+
+// CertOptions are optional certificate settings for a user or profile
+// which override the global settings. A zero Validity or nil
+// Extensions uses the global setting; an empty extensions map gives a
+// certificate with no extensions.
+type CertOptions struct {
+	Validity          uint32            `yaml:"validity"`
+	Extensions        map[string]string `yaml:"extensions"`
+	CriticalOptions   map[string]string `yaml:"critical_options"`
+	BindSourceAddress *SourceBinding    `yaml:"bind_source_address"`
+	AccessWindows     []string          `yaml:"access_windows"`
+	KeyType           string            `yaml:"key_type"`
+}
+
+// SourceBinding binds certificates to the network of the client that
+// requested them, by setting the source-address critical option to the
+// client's address widened to the given prefix lengths. Prefix lengths
+// of zero bind certificates to the client's address alone.
+type SourceBinding struct {
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+}
+
+// Profile is a named set of certificate settings for a user, selected
+// by the username the client uses when connecting to sshagentca, e.g.
+// `ssh -A prod@sshagentca`. Options not set in the profile are those
+// of the user. Users must give a reason for certificates for profiles
+// with RequireReason set.
+type Profile struct {
+	Principals    []string `yaml:"principals"`
+	RequireReason bool     `yaml:"require_reason"`
+	CertOptions   `yaml:",inline"`
 }
 
 // UnmarshalYAML unmarshals the Users slice of a yaml file
@@ -41,28 +177,52 @@ func (up *UserPrincipals) UnmarshalYAML(value *yaml.Node) (err error) {
 
 	// auxilliary unmarshall struct
 	type AuxUserPrincipals struct {
-		Name       string   `yaml:"name"`
-		Principals []string `yaml:"principals"`
-		PublicKey  string   `yaml:"sshpublickey"`
+		Name        string              `yaml:"name"`
+		Principals  []string            `yaml:"principals"`
+		PublicKey   string              `yaml:"sshpublickey"`
+		PublicKeys  []auxUserKey        `yaml:"sshpublickeys"`
+		Groups      []string            `yaml:"groups"`
+		Profiles    map[string]*Profile `yaml:"profiles"`
+		ValidFrom   time.Time           `yaml:"valid_from"`
+		ValidUntil  time.Time           `yaml:"valid_until"`
+		SignUserKey bool                `yaml:"sign_user_key"`
+		CertOptions `yaml:",inline"`
 	}
 
 	var aup AuxUserPrincipals
 	err = value.Decode(&aup)
 	if err != nil {
-		return fmt.Errorf("Yaml parsing error: %v", err)
+		return fmt.Errorf("line %d: Yaml parsing error: %v", value.Line, err)
 	}
 
-	pubKey, err := LoadPublicKeyBytes([]byte(aup.PublicKey))
-	if err != nil {
-		return fmt.Errorf("yaml error: user %s has an invalid public key: %w", aup.Name, err)
+	auxKeys := aup.PublicKeys
+	if aup.PublicKey != "" || len(auxKeys) == 0 {
+		auxKeys = append([]auxUserKey{{Key: aup.PublicKey}}, auxKeys...)
+	}
+	keys := []*UserKey{}
+	for _, ak := range auxKeys {
+		pubKey, err := LoadPublicKeyBytes([]byte(ak.Key))
+		if err != nil {
+			return fmt.Errorf("line %d: yaml error: user %s has an invalid public key: %w", value.Line, aup.Name, err)
+		}
+		keys = append(keys, &UserKey{
+			PublicKey:   pubKey,
+			Fingerprint: ssh.FingerprintSHA256(pubKey),
+			Label:       ak.Label,
+		})
 	}
-	fingerprint := string(ssh.FingerprintSHA256(pubKey))
 
 	*up = UserPrincipals{
 		Name:        aup.Name,
 		Principals:  aup.Principals,
-		PublicKey:   pubKey,
-		Fingerprint: fingerprint,
+		Keys:        keys,
+		Groups:      aup.Groups,
+		Profiles:    aup.Profiles,
+		ValidFrom:   aup.ValidFrom,
+		ValidUntil:  aup.ValidUntil,
+		SignUserKey: aup.SignUserKey,
+		CertOptions: aup.CertOptions,
+		line:        value.Line,
 	}
 
 	return err
@@ -72,12 +232,25 @@ func (up *UserPrincipals) UnmarshalYAML(value *yaml.Node) (err error) {
 // incorporates a slice of UserPrincipals together with general server
 // settings
 type Settings struct {
-	Validity           uint32            `yaml:"validity"`
-	Organisation       string            `yaml:"organisation"`
-	Banner             string            `yaml:"banner"`
-	Extensions         map[string]string `yaml:"extensions,flow"`
-	Users              []*UserPrincipals `yaml:"user_principals"`
+	Validity           uint32                      `yaml:"validity"`
+	Organisation       string                      `yaml:"organisation"`
+	Banner             string                      `yaml:"banner"`
+	KeyIDTemplate      string                      `yaml:"key_id"`
+	ReasonPattern      string                      `yaml:"reason_pattern"`
+	Approval           *Approval                   `yaml:"approval"`
+	KeyType            string                      `yaml:"key_type"`
+	CustomExtensions   map[string]*CustomExtension `yaml:"custom_extensions"`
+	Extensions         map[string]string           `yaml:"extensions,flow"`
+	CriticalOptions    map[string]string           `yaml:"critical_options"`
+	Groups             map[string]*Group           `yaml:"groups"`
+	Windows            map[string]*AccessWindow    `yaml:"access_windows"`
+	Users              []*UserPrincipals           `yaml:"user_principals"`
+	UsersDir           string                      `yaml:"users_dir"`
+	TOTPSecretsFile    string                      `yaml:"totp_secrets"`
 	usersByFingerprint map[string]*UserPrincipals
+	totpSecrets        map[string][]byte
+	reasonRE           *regexp.Regexp
+	sources            []string
 }
 
 // SettingsLoad loads a settings yaml file into a Settings struct
@@ -92,13 +265,33 @@ func SettingsLoad(yamlFilePath string) (Settings, error) {
 
 	err = yaml.Unmarshal(filer, &s)
 	if err != nil {
-		return s, err
+		return s, fmt.Errorf("%s: %w", yamlFilePath, err)
+	}
+	s.sources = []string{yamlFilePath}
+	for _, u := range s.Users {
+		u.file = yamlFilePath
+	}
+
+	// merge users from the users directory
+	if s.UsersDir != "" {
+		err = s.loadUsersDir(yamlFilePath)
+		if err != nil {
+			return s, err
+		}
 	}
 
 	if len(s.Users) == 0 {
 		return s, errors.New("no valid users found in yaml file")
 	}
 
+	// load the second factor secrets of users
+	if s.TOTPSecretsFile != "" {
+		err = s.loadTOTPSecrets(yamlFilePath)
+		if err != nil {
+			return s, err
+		}
+	}
+
 	// run validation
 	err = s.validate()
 	if err != nil {
@@ -122,10 +315,15 @@ func (s *Settings) UserByFingerprint(fp string) (*UserPrincipals, error) {
 func (s *Settings) buildFingerprintMap() error {
 	s.usersByFingerprint = map[string]*UserPrincipals{}
 	for _, u := range s.Users {
-		if _, ok := s.usersByFingerprint[u.Fingerprint]; ok {
-			return fmt.Errorf("user %s key already exists", u.Name)
+		for _, k := range u.Keys {
+			if other, ok := s.usersByFingerprint[k.Fingerprint]; ok {
+				if other.file == "" {
+					return u.sourceError(fmt.Errorf("user %s key already exists", u.Name))
+				}
+				return u.sourceError(fmt.Errorf("user %s key already exists at %s", u.Name, other.Source()))
+			}
+			s.usersByFingerprint[k.Fingerprint] = u
 		}
-		s.usersByFingerprint[u.Fingerprint] = u
 	}
 	return nil
 }
@@ -146,9 +344,162 @@ func (s *Settings) validate() error {
 		return fmt.Errorf("validity must be <%d", maxmins)
 	}
 
-	// check extensions meet permittedExtensions
-	for k, v := range s.Extensions {
+	// check key type
+	err = validateKeyType(s.KeyType)
+	if err != nil {
+		return err
+	}
+
+	// check reason pattern
+	err = s.validateReasonPattern()
+	if err != nil {
+		return err
+	}
+
+	// check key id template
+	err = s.validateKeyID()
+	if err != nil {
+		return err
+	}
+
+	// check custom extensions
+	err = s.validateCustomExtensions()
+	if err != nil {
+		return err
+	}
+
+	// check extensions meet permittedExtensions or custom_extensions
+	err = validateExtensions(s.Extensions)
+	if err != nil {
+		return err
+	}
+	err = s.checkCustomExtensions(s.Extensions)
+	if err != nil {
+		return err
+	}
+
+	// check critical options
+	err = validateCriticalOptions(s.CriticalOptions)
+	if err != nil {
+		return err
+	}
+
+	// check access windows
+	err = s.validateWindows()
+	if err != nil {
+		return err
+	}
+
+	// check groups
+	err = s.validateGroups()
+	if err != nil {
+		return err
+	}
+
+	// check users
+	for _, v := range s.Users {
+		if err := s.validateUser(v); err != nil {
+			return v.sourceError(err)
+		}
+	}
+
+	// check approval settings
+	err = s.validateApproval()
+	if err != nil {
+		return err
+	}
+
+	// check users have totp secrets if required
+	err = s.validateTOTPSecrets()
+	if err != nil {
+		return err
+	}
+
+	// check the principals, extensions and key id of each user render
+	// to permitted values
+	err = s.validateUserSpecs()
+	if err != nil {
+		return err
+	}
+
+	// check all users have a public keys
+	for fp, user := range s.usersByFingerprint {
+		k := user.Key(fp)
+		if k == nil || k.PublicKey == nil {
+			return user.sourceError(fmt.Errorf("user %s has empty public key", user.Name))
+		}
+		// some mangling has happened to a key?
+		if fp != ssh.FingerprintSHA256(k.PublicKey) {
+			return user.sourceError(fmt.Errorf("user %s public key mismatch", user.Name))
+		}
+	}
+
+	return nil
+}
+
+// validateUser checks a user's name, keys, principals and certificate
+// options
+func (s *Settings) validateUser(v *UserPrincipals) error {
+	if v.Name == "" {
+		return errors.New("user provided with empty name")
+	}
+	principals, err := s.PrincipalsFor(v)
+	if err != nil {
+		return err
+	}
+	if len(principals) == 0 {
+		return fmt.Errorf("user %s provided with no principals", v.Name)
+	} else if len(v.Keys) == 0 {
+		return fmt.Errorf("user %s has no publickey", v.Name)
+	}
+	labels := map[string]bool{}
+	for _, k := range v.Keys {
+		if k.Label == "" {
+			continue
+		}
+		if labels[k.Label] {
+			return fmt.Errorf("user %s has duplicate key label %s", v.Name, k.Label)
+		}
+		labels[k.Label] = true
+	}
+	if !v.ValidFrom.IsZero() && !v.ValidUntil.IsZero() && !v.ValidFrom.Before(v.ValidUntil) {
+		return fmt.Errorf("user %s valid_from must be before valid_until", v.Name)
+	}
+	if err := v.CertOptions.validate(); err != nil {
+		return fmt.Errorf("user %s %w", v.Name, err)
+	}
+	if err := s.checkCustomExtensions(v.Extensions); err != nil {
+		return fmt.Errorf("user %s %w", v.Name, err)
+	}
+	if err := s.validateWindowNames(v.AccessWindows); err != nil {
+		return fmt.Errorf("user %s %w", v.Name, err)
+	}
+	for name, p := range v.Profiles {
+		if err := p.validate(name); err != nil {
+			return fmt.Errorf("user %s %w", v.Name, err)
+		}
+		if err := s.validateWindowNames(p.AccessWindows); err != nil {
+			return fmt.Errorf("user %s profile %s %w", v.Name, name, err)
+		}
+		if err := s.checkCustomExtensions(p.Extensions); err != nil {
+			return fmt.Errorf("user %s profile %s %w", v.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// validate the extensions meet permittedExtensions, or are vendor
+// extensions with valid templated values. Vendor extensions are checked
+// against the custom extensions with the settings.
+func validateExtensions(extensions map[string]string) error {
+	for k, v := range extensions {
 		val, ok := permittedExtensions[k]
+		if !ok && isVendorExtension(k) {
+			if _, err := parseTemplate(v); err != nil {
+				return fmt.Errorf("extension %s value: %w", k, err)
+			}
+			continue
+		}
 		if !ok {
 			return fmt.Errorf("extension %s not permitted", k)
 		}
@@ -156,28 +507,233 @@ func (s *Settings) validate() error {
 			return fmt.Errorf("value '%s' for key %s not permitted, expected %s", val, k, v)
 		}
 	}
+	return nil
+}
 
-	// check users
-	for _, v := range s.Users {
-		if v.Name == "" {
-			return errors.New("user provided with empty name")
-		} else if len(v.Principals) == 0 {
-			return fmt.Errorf("user %s provided with no principals", v.Name)
-		} else if v.PublicKey == nil {
-			return fmt.Errorf("user %s has no publickey", v.Name)
-		}
+// validate a user profile
+func (p *Profile) validate(name string) error {
+	if p == nil {
+		return fmt.Errorf("profile %s is empty", name)
 	}
+	if name == "" {
+		return errors.New("profile provided with empty name")
+	}
+	if len(p.Principals) == 0 {
+		return fmt.Errorf("profile %s provided with no principals", name)
+	}
+	if err := p.CertOptions.validate(); err != nil {
+		return fmt.Errorf("profile %s %w", name, err)
+	}
+	return nil
+}
 
-	// check all users have a public keys
-	for fp, user := range s.usersByFingerprint {
-		if user.PublicKey == nil {
-			return fmt.Errorf("user %s has empty public key", user.Name)
+// validate user or profile certificate options, which may not exceed
+// the server maximum validity
+func (o *CertOptions) validate() error {
+	if o.Validity > maxmins {
+		return fmt.Errorf("validity must be <%d", maxmins)
+	}
+	if err := validateExtensions(o.Extensions); err != nil {
+		return err
+	}
+	if err := validateKeyType(o.KeyType); err != nil {
+		return err
+	}
+	if b := o.BindSourceAddress; b != nil {
+		if b.IPv4Prefix < 0 || b.IPv4Prefix > 32 {
+			return fmt.Errorf("bind_source_address ipv4_prefix %d must be from 0 to 32", b.IPv4Prefix)
 		}
-		// some mangling has happened to a key?
-		if fp != string(ssh.FingerprintSHA256(user.PublicKey)) {
-			return fmt.Errorf("user %s public key mismatch", user.Name)
+		if b.IPv6Prefix < 0 || b.IPv6Prefix > 128 {
+			return fmt.Errorf("bind_source_address ipv6_prefix %d must be from 0 to 128", b.IPv6Prefix)
 		}
 	}
+	return validateCriticalOptions(o.CriticalOptions)
+}
 
+// validate the critical options meet permittedCriticalOptions and that
+// source-address is a valid address list
+func validateCriticalOptions(options map[string]string) error {
+	for k, v := range options {
+		if !permittedCriticalOptions[k] {
+			return fmt.Errorf("critical option %s not permitted", k)
+		}
+		if strings.TrimSpace(v) == "" {
+			return fmt.Errorf("critical option %s has no value", k)
+		}
+		if k == "source-address" {
+			if _, err := ParseSourceAddress(v); err != nil {
+				return fmt.Errorf("critical option %s %w", k, err)
+			}
+		}
+	}
 	return nil
 }
+
+// ParseSourceAddress parses a source-address critical option, a comma
+// separated list of addresses or networks in CIDR format, e.g.
+// "192.168.1.0/24,10.0.0.1". Addresses without a prefix length are
+// returned as single address prefixes.
+func ParseSourceAddress(list string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, a := range strings.Split(list, ",") {
+		a = strings.TrimSpace(a)
+		if strings.Contains(a, "/") {
+			p, err := netip.ParsePrefix(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", a)
+			}
+			if p != p.Masked() {
+				return nil, fmt.Errorf("network %q has host bits set", a)
+			}
+			prefixes = append(prefixes, p)
+			continue
+		}
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", a)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// SettingsChanges describes the differences between old and new
+// settings, for logging when settings are reloaded. Users are compared
+// by public key fingerprint.
+func SettingsChanges(old, new *Settings) []string {
+
+	changes := []string{}
+	if old.Validity != new.Validity {
+		changes = append(changes, fmt.Sprintf("validity changed from %d to %d", old.Validity, new.Validity))
+	}
+	if old.Organisation != new.Organisation {
+		changes = append(changes, fmt.Sprintf("organisation changed from %s to %s", old.Organisation, new.Organisation))
+	}
+	if old.KeyType != new.KeyType {
+		changes = append(changes, fmt.Sprintf("key type changed from %q to %q", old.KeyType, new.KeyType))
+	}
+	if old.Banner != new.Banner {
+		changes = append(changes, "banner changed")
+	}
+	if totpSecretsChanged(old, new) {
+		changes = append(changes, "totp secrets changed")
+	}
+	if !reflect.DeepEqual(old.Approval, new.Approval) {
+		changes = append(changes, "approval settings changed")
+	}
+	if old.ReasonPattern != new.ReasonPattern {
+		changes = append(changes, fmt.Sprintf("reason pattern changed from %q to %q", old.ReasonPattern, new.ReasonPattern))
+	}
+	if old.KeyIDTemplate != new.KeyIDTemplate {
+		changes = append(changes, fmt.Sprintf("key id changed from %q to %q", old.KeyIDTemplate, new.KeyIDTemplate))
+	}
+	if !reflect.DeepEqual(old.CustomExtensions, new.CustomExtensions) {
+		changes = append(changes, "custom extensions changed")
+	}
+	if !maps.Equal(old.Extensions, new.Extensions) {
+		changes = append(changes, fmt.Sprintf("extensions changed from %v to %v", old.Extensions, new.Extensions))
+	}
+	if !maps.Equal(old.CriticalOptions, new.CriticalOptions) {
+		changes = append(changes, fmt.Sprintf("critical options changed from %v to %v", old.CriticalOptions, new.CriticalOptions))
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(new.Groups)) {
+		o, ok := old.Groups[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("group %s added", name))
+		case !reflect.DeepEqual(o, new.Groups[name]):
+			changes = append(changes, fmt.Sprintf("group %s changed", name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(old.Groups)) {
+		if _, ok := new.Groups[name]; !ok {
+			changes = append(changes, fmt.Sprintf("group %s removed", name))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(new.Windows)) {
+		o, ok := old.Windows[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("access window %s added", name))
+		case !reflect.DeepEqual(o, new.Windows[name]):
+			changes = append(changes, fmt.Sprintf("access window %s changed", name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(old.Windows)) {
+		if _, ok := new.Windows[name]; !ok {
+			changes = append(changes, fmt.Sprintf("access window %s removed", name))
+		}
+	}
+
+	oldUsers := map[string]*UserPrincipals{}
+	for _, u := range old.Users {
+		for _, k := range u.Keys {
+			oldUsers[k.Fingerprint] = u
+		}
+	}
+	newUsers := map[string]*UserPrincipals{}
+	for _, u := range new.Users {
+		var o *UserPrincipals
+		for _, k := range u.Keys {
+			newUsers[k.Fingerprint] = u
+			if o == nil {
+				o = oldUsers[k.Fingerprint]
+			}
+		}
+		ok := o != nil
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("user %s added with key %s", u.Name, u.Keys[0].Fingerprint))
+		case o.Name != u.Name:
+			changes = append(changes, fmt.Sprintf("user %s renamed to %s for key %s", o.Name, u.Name, u.Keys[0].Fingerprint))
+		}
+		if !ok {
+			continue
+		}
+		for _, k := range u.Keys {
+			if o.Key(k.Fingerprint) == nil {
+				changes = append(changes, fmt.Sprintf("user %s key %s added", u.Name, k.Fingerprint))
+			}
+		}
+		for _, k := range o.Keys {
+			if u.Key(k.Fingerprint) == nil && newUsers[k.Fingerprint] == nil {
+				changes = append(changes, fmt.Sprintf("user %s key %s removed", u.Name, k.Fingerprint))
+			}
+		}
+		if !slices.Equal(o.Principals, u.Principals) {
+			changes = append(changes, fmt.Sprintf("user %s principals changed from %v to %v", u.Name, o.Principals, u.Principals))
+		}
+		if !slices.Equal(o.Groups, u.Groups) {
+			changes = append(changes, fmt.Sprintf("user %s groups changed from %v to %v", u.Name, o.Groups, u.Groups))
+		}
+		if !maps.EqualFunc(o.Profiles, u.Profiles, func(a, b *Profile) bool { return reflect.DeepEqual(a, b) }) {
+			changes = append(changes, fmt.Sprintf("user %s profiles changed", u.Name))
+		}
+		if !o.ValidFrom.Equal(u.ValidFrom) || !o.ValidUntil.Equal(u.ValidUntil) {
+			changes = append(changes, fmt.Sprintf("user %s account dates changed to valid from %s until %s", u.Name, accountDate(u.ValidFrom), accountDate(u.ValidUntil)))
+		}
+		if o.SignUserKey != u.SignUserKey {
+			changes = append(changes, fmt.Sprintf("user %s sign_user_key changed to %t", u.Name, u.SignUserKey))
+		}
+		if !reflect.DeepEqual(o.CertOptions, u.CertOptions) {
+			changes = append(changes, fmt.Sprintf("user %s certificate options changed from %+v to %+v", u.Name, o.CertOptions, u.CertOptions))
+		}
+	}
+	for _, u := range old.Users {
+		if !slices.ContainsFunc(u.Keys, func(k *UserKey) bool { return newUsers[k.Fingerprint] != nil }) {
+			changes = append(changes, fmt.Sprintf("user %s removed with key %s", u.Name, u.Keys[0].Fingerprint))
+		}
+	}
+	return changes
+}
+
+// accountDate formats a user account date for reporting, which may be
+// unset
+func accountDate(t time.Time) string {
+	if t.IsZero() {
+		return "unset"
+	}
+	return t.Format(time.RFC3339)
+}
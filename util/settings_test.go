@@ -4,9 +4,14 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"maps"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	yaml "gopkg.in/yaml.v3"
 )
 
 func TestSettingsParse(t *testing.T) {
@@ -94,7 +99,7 @@ func TestSettingsParse7(t *testing.T) {
 func TestSettingsParse8(t *testing.T) {
 	_, err := SettingsLoad("testdata/settings_broken2.yaml")
 	t.Logf("%+v", err)
-	if !ErrorContains(err, "yaml error: user bill has an invalid public key: ssh: no key found") {
+	if !ErrorContains(err, "testdata/settings_broken2.yaml: line 18: yaml error: user bill has an invalid public key: ssh: no key found") {
 		t.Errorf("Unexpected error %v", err)
 	}
 }
@@ -143,7 +148,7 @@ func TestUserSettings1(t *testing.T) {
 	if len(settings.Users) != 2 {
 		t.Errorf("unexpected user length encountered")
 	}
-	settings.Users[0].Fingerprint = settings.Users[0].Fingerprint[1:]
+	settings.Users[0].Keys[0].Fingerprint = settings.Users[0].Keys[0].Fingerprint[1:]
 	err = settings.validate()
 	t.Logf("Error (expected): SHA error %s", err)
 	if err == nil {
@@ -156,7 +161,7 @@ func TestUserSettings2(t *testing.T) {
 	if err != nil {
 		t.Errorf("Could not parse yaml %v", err)
 	}
-	settings.Users[0].Fingerprint = settings.Users[0].Fingerprint[:49]
+	settings.Users[0].Keys[0].Fingerprint = settings.Users[0].Keys[0].Fingerprint[:49]
 	err = settings.validate()
 	t.Logf("Error (expected): fingerprint length error %s", err)
 	if err == nil {
@@ -208,12 +213,12 @@ func TestUserSettings6(t *testing.T) {
 	if err != nil {
 		t.Errorf("Could not parse yaml %v", err)
 	}
-	fp := settings.Users[0].Fingerprint
+	fp := settings.Users[0].Keys[0].Fingerprint
 	_, err = settings.UserByFingerprint(fp)
 	if err != nil {
 		t.Errorf("UserByFingerprint lookup failed")
 	}
-	fp = settings.Users[0].Fingerprint[1:]
+	fp = settings.Users[0].Keys[0].Fingerprint[1:]
 	_, err = settings.UserByFingerprint(fp)
 	if err == nil {
 		t.Errorf("Invalid UserByFingerprint lookup succeeded")
@@ -225,7 +230,7 @@ func TestUserAuth1(t *testing.T) {
 	if err != nil {
 		t.Errorf("Could not parse yaml %v", err)
 	}
-	settings.Users[0].PublicKey = nil
+	settings.Users[0].Keys[0].PublicKey = nil
 	err = settings.validate()
 	if err == nil {
 		t.Errorf("nil publickey should not be allowed")
@@ -245,7 +250,7 @@ func TestUserAuth2(t *testing.T) {
 	if err != nil {
 		panic("Could not generate test pubkey")
 	}
-	settings.Users[0].PublicKey = pubKey
+	settings.Users[0].Keys[0].PublicKey = pubKey
 	err = settings.validate()
 	if err == nil {
 		t.Errorf("invalid publickey should not be allowed")
@@ -258,3 +263,398 @@ func TestSettingsValidate(t *testing.T) {
 		t.Errorf("validation failed")
 	}
 }
+
+func TestSettingsChanges(t *testing.T) {
+	old, err := SettingsLoad("../settings.example.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	new, err := SettingsLoad("../settings.example.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	if changes := SettingsChanges(&old, &new); len(changes) != 0 {
+		t.Errorf("unexpected changes %v", changes)
+	}
+
+	new.Validity = 60
+	new.Users[0].Principals = []string{"web"}
+	new.Users = new.Users[:1]
+	changes := SettingsChanges(&old, &new)
+	t.Logf("changes %v", changes)
+	want := []string{
+		"validity changed from 180 to 60",
+		"user jane principals changed from [web database root] to [web]",
+		"user john removed with key",
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes, want %d", len(changes), len(want))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(changes[i], w) {
+			t.Errorf("change %d: got %q want %q", i, changes[i], w)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	settings, err := SettingsLoad("../settings.example.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	jane, john := settings.Users[0], settings.Users[1]
+
+	tests := []struct {
+		user       *UserPrincipals
+		username   string
+		profile    string
+		err        string
+		principals []string
+		validity   uint32
+	}{
+		{jane, "jane", "", "", []string{"web", "database", "root"}, 180},
+		{jane, "prod", "prod", "", []string{"root"}, 30},
+		{john, "anything", "", "", []string{"web", "database"}, 180},
+		{john, "prod", "", "user john is not entitled to profile prod", nil, 0},
+	}
+	for _, tt := range tests {
+		profile, err := settings.SelectProfile(tt.user, tt.username)
+		if !ErrorContains(err, tt.err) {
+			t.Errorf("%s@%s: unexpected error %v", tt.user.Name, tt.username, err)
+		}
+		if err != nil {
+			continue
+		}
+		if profile != tt.profile {
+			t.Errorf("%s@%s: got profile %q want %q", tt.user.Name, tt.username, profile, tt.profile)
+		}
+		spec, err := settings.CertSpec(tt.user, profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(spec.Principals, tt.principals) || spec.Validity != tt.validity {
+			t.Errorf("%s@%s: got spec %+v", tt.user.Name, tt.username, spec)
+		}
+		if tt.user == jane && !maps.Equal(spec.Extensions, settings.Extensions) {
+			t.Errorf("%s@%s: profile extensions not inherited", tt.user.Name, tt.username)
+		}
+	}
+}
+
+func TestProfilesValidate(t *testing.T) {
+	tests := []struct {
+		profile *Profile
+		err     string
+	}{
+		{&Profile{Principals: []string{"root"}}, ""},
+		{nil, "user jane profile prod is empty"},
+		{&Profile{}, "user jane profile prod provided with no principals"},
+		{&Profile{Principals: []string{"root"}, CertOptions: CertOptions{Validity: maxmins + 1}}, "user jane profile prod validity must be"},
+		{&Profile{Principals: []string{"root"}, CertOptions: CertOptions{Extensions: map[string]string{"bad": ""}}}, "user jane profile prod extension bad not permitted"},
+	}
+	for _, tt := range tests {
+		settings, err := SettingsLoad("../settings.example.yaml")
+		if err != nil {
+			t.Fatalf("Could not parse yaml %v", err)
+		}
+		settings.Users[0].Profiles["prod"] = tt.profile
+		err = settings.validate()
+		if !ErrorContains(err, tt.err) {
+			t.Errorf("Unexpected error %v, want %q", err, tt.err)
+		}
+	}
+}
+
+func TestUserCertOptions(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_options.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	john := settings.Users[1]
+	spec, err := settings.CertSpec(john, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Validity != 60 {
+		t.Errorf("user validity not applied: %d", spec.Validity)
+	}
+	if len(spec.Extensions) != 1 || spec.Extensions["permit-pty"] != "" {
+		t.Errorf("user extensions not applied: %v", spec.Extensions)
+	}
+	if spec.CriticalOptions["force-command"] != "/usr/bin/uptime" {
+		t.Errorf("user critical options not applied: %v", spec.CriticalOptions)
+	}
+
+	// profiles inherit the user's options
+	john.Profiles = map[string]*Profile{"ops": {Principals: []string{"ops"}, CertOptions: CertOptions{Validity: 10}}}
+	spec, err = settings.CertSpec(john, "ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Validity != 10 || spec.CriticalOptions["force-command"] != "/usr/bin/uptime" || len(spec.Extensions) != 1 {
+		t.Errorf("profile did not inherit user options: %+v", spec)
+	}
+}
+
+func TestUserCertOptionsValidate(t *testing.T) {
+	tests := []struct {
+		options CertOptions
+		err     string
+	}{
+		{CertOptions{Validity: maxmins}, ""},
+		{CertOptions{Validity: maxmins + 1}, "user john validity must be"},
+		{CertOptions{Extensions: map[string]string{"permit-pty": "x"}}, "user john value"},
+		{CertOptions{CriticalOptions: map[string]string{"verify-required": "x"}}, "user john critical option verify-required not permitted"},
+		{CertOptions{CriticalOptions: map[string]string{"force-command": ""}}, "user john critical option force-command has no value"},
+	}
+	for _, tt := range tests {
+		settings, err := SettingsLoad("testdata/settings_options.yaml")
+		if err != nil {
+			t.Fatalf("Could not parse yaml %v", err)
+		}
+		settings.Users[1].CertOptions = tt.options
+		err = settings.validate()
+		if !ErrorContains(err, tt.err) {
+			t.Errorf("Unexpected error %v, want %q", err, tt.err)
+		}
+	}
+}
+
+func TestCriticalOptions(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_options.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	jane, john := settings.Users[0], settings.Users[1]
+
+	// global critical options apply, and are merged with user options
+	spec, err := settings.CertSpec(jane, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.CriticalOptions["source-address"] != "10.0.0.0/8,192.168.1.0/24" {
+		t.Errorf("global critical options not applied: %v", spec.CriticalOptions)
+	}
+	spec, err = settings.CertSpec(john, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"source-address": "10.0.0.0/8,192.168.1.0/24", "force-command": "/usr/bin/uptime"}
+	if !maps.Equal(spec.CriticalOptions, want) {
+		t.Errorf("got critical options %v want %v", spec.CriticalOptions, want)
+	}
+	if len(settings.CriticalOptions) != 1 {
+		t.Errorf("global critical options modified by merge: %v", settings.CriticalOptions)
+	}
+}
+
+func TestCriticalOptionsValidate(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		err     string
+	}{
+		{map[string]string{"source-address": "10.0.0.1"}, ""},
+		{map[string]string{"source-address": "10.0.0.0/8, 2001:db8::/32"}, ""},
+		{map[string]string{"source-address": "10.0.0.0/33"}, `critical option source-address invalid network "10.0.0.0/33"`},
+		{map[string]string{"source-address": "10.0.0.1/8"}, `critical option source-address network "10.0.0.1/8" has host bits set`},
+		{map[string]string{"source-address": "office"}, `critical option source-address invalid address "office"`},
+		{map[string]string{"source-address": "10.0.0.1,"}, `critical option source-address invalid address ""`},
+		{map[string]string{"force-command": " "}, "critical option force-command has no value"},
+		{map[string]string{"no-touch-required": "x"}, "critical option no-touch-required not permitted"},
+	}
+	for _, tt := range tests {
+		settings, err := SettingsLoad("../settings.example.yaml")
+		if err != nil {
+			t.Fatalf("Could not parse yaml %v", err)
+		}
+		settings.CriticalOptions = tt.options
+		err = settings.validate()
+		if !ErrorContains(err, tt.err) {
+			t.Errorf("Unexpected error %v, want %q", err, tt.err)
+		}
+	}
+}
+
+func TestMultipleKeys(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_keys.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	alice := settings.Users[0]
+	labels := []string{"laptop", "token", ""}
+	if len(alice.Keys) != len(labels) {
+		t.Fatalf("got %d keys want %d", len(alice.Keys), len(labels))
+	}
+	for i, k := range alice.Keys {
+		if k.Label != labels[i] {
+			t.Errorf("key %d label %q want %q", i, k.Label, labels[i])
+		}
+		user, err := settings.UserByFingerprint(k.Fingerprint)
+		if err != nil || user != alice {
+			t.Errorf("key %d not indexed to alice: %v", i, err)
+		}
+		if alice.Key(k.Fingerprint) != k {
+			t.Errorf("key %d not found by fingerprint", i)
+		}
+	}
+	if got := alice.Keys[0].String(); !strings.HasSuffix(got, " (laptop)") {
+		t.Errorf("unexpected key description %q", got)
+	}
+	if len(settings.Users[1].Keys) != 1 || settings.Users[1].Keys[0].Label != "" {
+		t.Errorf("unexpected single key %+v", settings.Users[1].Keys)
+	}
+}
+
+func TestMultipleKeysValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(s *Settings)
+		err    string
+	}{
+		{"duplicate label", func(s *Settings) { s.Users[0].Keys[1].Label = "laptop" }, "user alice has duplicate key label laptop"},
+		{"key shared with other user", func(s *Settings) { s.Users[1].Keys = append(s.Users[1].Keys, s.Users[0].Keys[2]) }, "user bob key already exists"},
+		{"no keys", func(s *Settings) { s.Users[1].Keys = nil }, "user bob has no publickey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := SettingsLoad("testdata/settings_keys.yaml")
+			if err != nil {
+				t.Fatalf("Could not parse yaml %v", err)
+			}
+			tt.mangle(&settings)
+			err = settings.validate()
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMultipleKeysChanges(t *testing.T) {
+	old, err := SettingsLoad("testdata/settings_keys.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	new, err := SettingsLoad("testdata/settings_keys.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	removed := new.Users[0].Keys[1].Fingerprint
+	new.Users[0].Keys = slices.Delete(new.Users[0].Keys, 1, 2)
+	changes := SettingsChanges(&old, &new)
+	want := []string{"user alice key " + removed + " removed"}
+	if !slices.Equal(changes, want) {
+		t.Errorf("got changes %v want %v", changes, want)
+	}
+}
+
+func TestAccountDates(t *testing.T) {
+	var s Settings
+	err := yaml.Unmarshal([]byte(`
+user_principals:
+    -
+        name: contractor
+        sshpublickey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHbnCfkNiWUUMUcudbFVHU1pefuFfmz8gbtTMVA0hdWD bob@test.com"
+        principals:
+            - web
+        valid_from: 2026-01-01
+        valid_until: 2026-06-30T17:00:00Z
+`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := s.Users[0]
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2026, 6, 30, 17, 0, 0, 0, time.UTC)
+	if !u.ValidFrom.Equal(from) || !u.ValidUntil.Equal(until) {
+		t.Fatalf("unexpected dates %s %s", u.ValidFrom, u.ValidUntil)
+	}
+
+	tests := []struct {
+		at  time.Time
+		err string
+	}{
+		{from.Add(-time.Second), "user contractor account not valid until 2026-01-01T00:00:00Z"},
+		{from, ""},
+		{until.Add(-time.Second), ""},
+		{until, "user contractor account expired at 2026-06-30T17:00:00Z"},
+	}
+	for _, tt := range tests {
+		err := u.ActiveAt(tt.at)
+		if tt.err == "" && err != nil || tt.err != "" && !ErrorContains(err, tt.err) {
+			t.Errorf("at %s got error %v want %q", tt.at, err, tt.err)
+		}
+	}
+
+	if got := u.CapValidBefore(until.Add(time.Hour)); !got.Equal(until) {
+		t.Errorf("valid before not capped: %s", got)
+	}
+	if got := u.CapValidBefore(until.Add(-time.Hour)); !got.Equal(until.Add(-time.Hour)) {
+		t.Errorf("valid before capped unnecessarily: %s", got)
+	}
+	u.ValidUntil = time.Time{}
+	if got := u.CapValidBefore(until.Add(time.Hour)); !got.Equal(until.Add(time.Hour)) {
+		t.Errorf("valid before capped without valid_until: %s", got)
+	}
+}
+
+func TestAccountDatesValidate(t *testing.T) {
+	settings, err := SettingsLoad("../settings.example.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	settings.Users[0].ValidFrom = time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	settings.Users[0].ValidUntil = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = settings.validate()
+	if !ErrorContains(err, "user jane valid_from must be before valid_until") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestKeyType(t *testing.T) {
+	settings, err := SettingsLoad("../settings.example.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	jane := settings.Users[0]
+	settings.KeyType = "ecdsa-p256"
+	jane.KeyType = "rsa-4096"
+	jane.Profiles["prod"].KeyType = "ecdsa-p384"
+
+	tests := []struct {
+		profile string
+		keyType string
+	}{
+		{"", "rsa-4096"},
+		{"prod", "ecdsa-p384"},
+	}
+	for _, tt := range tests {
+		spec, err := settings.CertSpec(jane, tt.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spec.KeyType != tt.keyType {
+			t.Errorf("profile %q got key type %s want %s", tt.profile, spec.KeyType, tt.keyType)
+		}
+	}
+	spec, err := settings.CertSpec(settings.Users[1], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.KeyType != "ecdsa-p256" {
+		t.Errorf("got global key type %s", spec.KeyType)
+	}
+
+	if err := settings.validate(); err != nil {
+		t.Errorf("unexpected validation error %v", err)
+	}
+	jane.KeyType = "dsa"
+	if err := settings.validate(); !ErrorContains(err, "user jane key_type dsa not supported") {
+		t.Errorf("unexpected error %v", err)
+	}
+	jane.KeyType = ""
+	settings.KeyType = "rsa-1024"
+	if err := settings.validate(); !ErrorContains(err, "key_type rsa-1024 not supported") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
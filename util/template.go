@@ -0,0 +1,151 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// TemplateData is the data available to templated principals and
+// extension values, such as "{{.Name}}-admin"
+type TemplateData struct {
+	Name    string // the user's name
+	Profile string // the selected profile, empty for the user's defaults
+}
+
+// GroupTemplateData is the data available to templated group
+// principals, such as "team-{{.Group}}"
+type GroupTemplateData struct {
+	TemplateData
+	Group string // the group granting the principal
+}
+
+// KeyIDData is the data available to the key_id template
+type KeyIDData struct {
+	TemplateData
+	Organisation string
+	Label        string // the label of the user's key
+	Serial       uint64
+	From         string // validity start, e.g. 2026-01-02T15:04
+	To           string // validity end, e.g. 2026-01-02T18:04UTC
+	Reason       string // the reason given, for profiles requiring one
+}
+
+// maxTemplateOutput limits the length of a rendered template
+const maxTemplateOutput = 256
+
+// templateFuncs are the functions available to templates in addition
+// to the permitted builtins
+var templateFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": strings.ReplaceAll,
+}
+
+// templateBuiltins are the text/template builtin functions permitted
+// in templates
+var templateBuiltins = map[string]bool{
+	"and": true, "or": true, "not": true, "eq": true, "ne": true,
+	"len": true, "printf": true,
+}
+
+// parseTemplate parses a templated settings value. Templates are
+// sandboxed: only the fields of the template data, the templateFuncs
+// and some builtins may be used, and templates may not define or
+// include other templates or loop. Referring to fields not in the
+// template data is an error when the template is executed.
+func parseTemplate(text string) (*template.Template, error) {
+	t, err := template.New("").Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Templates()) > 1 {
+		return nil, errors.New("template definitions not permitted")
+	}
+	if t.Tree != nil {
+		if err := checkTemplateNode(t.Tree.Root); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// checkTemplateNode checks the template parse tree only uses permitted
+// actions and functions
+func checkTemplateNode(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkTemplateNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkTemplateNode(n.Pipe)
+	case *parse.IfNode:
+		for _, c := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+			if err := checkTemplateNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Cmds {
+			if err := checkTemplateNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		for _, c := range n.Args {
+			if err := checkTemplateNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.IdentifierNode:
+		if _, ok := templateFuncs[n.Ident]; !ok && !templateBuiltins[n.Ident] {
+			return fmt.Errorf("template function %s not permitted", n.Ident)
+		}
+	case *parse.TextNode, *parse.FieldNode, *parse.DotNode, *parse.StringNode,
+		*parse.NumberNode, *parse.BoolNode, *parse.VariableNode:
+	default:
+		return fmt.Errorf("template action %q not permitted", node)
+	}
+	return nil
+}
+
+// limitedWriter is a strings.Builder which refuses writes beyond
+// maxTemplateOutput
+type limitedWriter struct {
+	strings.Builder
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > maxTemplateOutput {
+		return 0, fmt.Errorf("template output longer than %d bytes", maxTemplateOutput)
+	}
+	return w.Builder.Write(p)
+}
+
+// renderTemplate renders a templated settings value with data
+func renderTemplate(text string, data any) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var w limitedWriter
+	if err := t.Execute(&w, data); err != nil {
+		return "", err
+	}
+	return w.String(), nil
+}
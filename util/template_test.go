@@ -0,0 +1,143 @@
+package util
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	data := GroupTemplateData{TemplateData{Name: "alice", Profile: "admin"}, "web"}
+	tests := []struct {
+		text string
+		want string
+		err  string
+	}{
+		{"plain", "plain", ""},
+		{"{{.Name}}-{{.Profile}}", "alice-admin", ""},
+		{"team-{{.Group}}", "team-web", ""},
+		{"{{upper .Name}}", "ALICE", ""},
+		{`{{replace .Name "a" "4"}}`, "4lice", ""},
+		{`{{if eq .Profile "admin"}}root{{else}}{{.Name}}{{end}}`, "root", ""},
+		{`{{printf "%s@%s" .Name .Group}}`, "alice@web", ""},
+		{"{{.Name", "", "unclosed action"},
+		{"{{.Email}}", "", "can't evaluate field Email"},
+		{"{{call .Name}}", "", "template function call not permitted"},
+		{`{{html .Name}}`, "", "template function html not permitted"},
+		{`{{define "x"}}y{{end}}`, "", "template definitions not permitted"},
+		{`{{template "x"}}`, "", "not permitted"},
+		{`{{range .Name}}x{{end}}`, "", "not permitted"},
+		{`{{with .Name}}x{{end}}`, "", "not permitted"},
+		{`{{printf "%0300d" 1}}`, "", "template output longer than 256 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := renderTemplate(tt.text, data)
+			if tt.err != "" {
+				if !ErrorContains(err, tt.err) {
+					t.Errorf("got error %v want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplatedPrincipals(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	alice := settings.Users[0]
+
+	tests := []struct {
+		profile    string
+		principals []string
+	}{
+		{"", []string{"alice", "team-web", "team-dba"}},
+		{"admin", []string{"alice-admin", "ALICE"}},
+	}
+	for _, tt := range tests {
+		spec, err := settings.CertSpec(alice, tt.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(spec.Principals, tt.principals) {
+			t.Errorf("profile %q got principals %v want %v", tt.profile, spec.Principals, tt.principals)
+		}
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_templates.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	from := time.Date(2026, 3, 4, 9, 30, 0, 0, time.UTC)
+	data := settings.NewKeyIDData(TemplateData{Name: "alice", Profile: "admin"}, "laptop", 42, from, from.Add(time.Hour), "")
+
+	got, err := settings.KeyID(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "acmeinc:alice:admin:42"; got != want {
+		t.Errorf("got key id %q want %q", got, want)
+	}
+
+	settings.KeyIDTemplate = ""
+	got, err = settings.KeyID(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "acmeinc_alice_laptop_admin_from:2026-03-04T09:30_to:2026-03-04T10:30UTC"; got != want {
+		t.Errorf("got default key id %q want %q", got, want)
+	}
+}
+
+func TestTemplatesValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(s *Settings)
+		err    string
+	}{
+		{"key id parse", func(s *Settings) { s.KeyIDTemplate = "{{.Name" }, "key_id: template"},
+		{"key id unknown field", func(s *Settings) { s.KeyIDTemplate = "{{.Email}}" }, "key_id: template"},
+		{"key id function", func(s *Settings) { s.KeyIDTemplate = `{{call .Name}}` }, "key_id: template function call not permitted"},
+		{"key id empty", func(s *Settings) { s.KeyIDTemplate = `{{if false}}x{{end}}` }, "key_id renders to an empty key id"},
+		{"key id too long", func(s *Settings) { s.KeyIDTemplate = strings.Repeat("{{.Name}}", 60) }, "template output longer than 256 bytes"},
+		{"principal parse", func(s *Settings) { s.Users[0].Principals = []string{"{{.Name"} }, "user alice principal {{.Name: template"},
+		{"principal field", func(s *Settings) { s.Users[0].Principals = []string{"{{.Serial}}"} }, "user alice principal {{.Serial}}"},
+		{"principal empty", func(s *Settings) { s.Users[0].Principals = []string{"{{.Profile}}"} }, `renders to invalid principal ""`},
+		{"principal comma", func(s *Settings) { s.Users[0].Name = "alice,root" }, `renders to invalid principal "alice,root"`},
+		{"principal group", func(s *Settings) { s.Users[0].Principals = []string{"team-{{.Group}}"} },
+			"user alice principal team-{{.Group}}: template"},
+		{"group principal", func(s *Settings) { s.Groups["web"].Principals = []string{"{{.Nmae}}"} }, "user alice group web principal {{.Nmae}}"},
+		{"profile principal", func(s *Settings) {
+			s.Users[0].Profiles["admin"].Principals = []string{"{{lower}}"}
+		}, "user alice profile admin principal {{lower}}"},
+		{"profile principal group", func(s *Settings) {
+			s.Users[0].Profiles["admin"].Principals = []string{"team-{{.Group}}"}
+		}, "user alice profile admin principal team-{{.Group}}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := SettingsLoad("testdata/settings_templates.yaml")
+			if err != nil {
+				t.Fatalf("Could not parse yaml %v", err)
+			}
+			tt.mangle(&settings)
+			err = settings.validate()
+			t.Log(err)
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}
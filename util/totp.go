@@ -0,0 +1,151 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TOTP codes follow the RFC 6238 defaults used by authenticator apps:
+// six digit HMAC-SHA1 codes for 30 second time steps. Codes for the
+// steps either side of the current step are accepted to allow for
+// clock skew.
+const (
+	totpStep   = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+// ErrTOTPInvalid is returned for a TOTP code which is not current
+var ErrTOTPInvalid = errors.New("invalid verification code")
+
+// loadTOTPSecrets loads the base32 TOTP secrets of users from the
+// totp_secrets file, a yaml mapping of user names to secrets. A
+// relative path is relative to the directory of the settings file at
+// settingsPath. The file must not be accessible to group or others.
+func (s *Settings) loadTOTPSecrets(settingsPath string) error {
+
+	path := s.TOTPSecretsFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(settingsPath), path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("could not read totp_secrets: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("totp_secrets %s must not be accessible to group or others", path)
+	}
+	filer, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read totp_secrets: %w", err)
+	}
+	secrets := map[string]string{}
+	err = yaml.Unmarshal(filer, &secrets)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	s.sources = append(s.sources, path)
+
+	s.totpSecrets = map[string][]byte{}
+	for name, secret := range secrets {
+		key, err := decodeTOTPSecret(secret)
+		if err != nil {
+			return fmt.Errorf("%s: user %s totp secret %w", path, name, err)
+		}
+		s.totpSecrets[name] = key
+	}
+	return nil
+}
+
+// decodeTOTPSecret decodes a base32 secret, ignoring case, spaces and
+// padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, errors.New("is not valid base32")
+	}
+	if len(key) < 10 {
+		return nil, errors.New("must be at least 80 bits")
+	}
+	return key, nil
+}
+
+// validateTOTPSecrets checks every user has a TOTP secret, and every
+// secret is for a user, if TOTP codes are required
+func (s *Settings) validateTOTPSecrets() error {
+	if !s.TOTPRequired() {
+		return nil
+	}
+	names := map[string]bool{}
+	for _, u := range s.Users {
+		names[u.Name] = true
+		if _, ok := s.totpSecrets[u.Name]; !ok {
+			return u.sourceError(fmt.Errorf("user %s has no totp secret", u.Name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.totpSecrets)) {
+		if !names[name] {
+			return fmt.Errorf("totp secret for unknown user %s", name)
+		}
+	}
+	return nil
+}
+
+// TOTPRequired reports if users must give a TOTP verification code as
+// a second factor
+func (s *Settings) TOTPRequired() bool {
+	return s.TOTPSecretsFile != ""
+}
+
+// CheckTOTP checks code is a current TOTP code for the user at t,
+// returning the time step of the code so that the caller can refuse
+// codes which have already been used
+func (s *Settings) CheckTOTP(user *UserPrincipals, code string, t time.Time) (int64, error) {
+	key, ok := s.totpSecrets[user.Name]
+	if !ok {
+		return 0, fmt.Errorf("user %s has no totp secret", user.Name)
+	}
+	code = strings.TrimSpace(code)
+	now := t.Unix() / totpStep
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrTOTPInvalid
+}
+
+// totpCode returns the code for the time step, as set out in RFC 4226
+// and RFC 6238
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	_ = binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// totpSecretsChanged reports if the TOTP secrets differ
+func totpSecretsChanged(old, new *Settings) bool {
+	return old.TOTPSecretsFile != new.TOTPSecretsFile ||
+		!maps.EqualFunc(old.totpSecrets, new.totpSecrets, hmac.Equal)
+}
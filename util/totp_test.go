@@ -0,0 +1,117 @@
+package util
+
+import (
+	"encoding/base32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the RFC 6238 appendix B SHA1 test vectors, truncated to six digits
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpStep); got != tt.code {
+			t.Errorf("at %d got %s want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+// writeTOTPSettings writes settings with a relative totp_secrets file
+// holding secrets to a temporary directory, returning the settings path
+func writeTOTPSettings(t *testing.T, secrets string, mode os.FileMode) string {
+	t.Helper()
+	dir := t.TempDir()
+	settings, err := os.ReadFile("testdata/settings_keys.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings = append(settings, []byte("\ntotp_secrets: totp.yaml\n")...)
+	path := filepath.Join(dir, "settings.yaml")
+	if err := os.WriteFile(path, settings, 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretsPath := filepath.Join(dir, "totp.yaml")
+	if err := os.WriteFile(secretsPath, []byte(secrets), mode); err != nil {
+		t.Fatal(err)
+	}
+	// set the mode regardless of the umask
+	if err := os.Chmod(secretsPath, mode); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testTOTPSecrets = `
+alice: GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ
+bob: "gezd gnbv gy3t qojq"
+`
+
+func TestCheckTOTP(t *testing.T) {
+	settings, err := SettingsLoad(writeTOTPSettings(t, testTOTPSecrets, 0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.TOTPRequired() {
+		t.Fatal("totp not required")
+	}
+	alice := settings.Users[0]
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpStep
+
+	tests := []struct {
+		code string
+		step int64
+		err  bool
+	}{
+		{"050471", step, false},
+		{" 050471 ", step, false},
+		{totpCode([]byte("12345678901234567890"), step-1), step - 1, false},
+		{totpCode([]byte("12345678901234567890"), step+1), step + 1, false},
+		{totpCode([]byte("12345678901234567890"), step-2), 0, true},
+		{"050472", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := settings.CheckTOTP(alice, tt.code, now)
+		if (err != nil) != tt.err || got != tt.step {
+			t.Errorf("code %q got step %d error %v", tt.code, got, err)
+		}
+	}
+}
+
+func TestTOTPSecretsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets string
+		mode    os.FileMode
+		err     string
+	}{
+		{"missing user", "alice: " + base32.StdEncoding.EncodeToString([]byte("12345678901234567890")), 0600, "user bob has no totp secret"},
+		{"unknown user", testTOTPSecrets + "bill: GEZDGNBVGY3TQOJQ\n", 0600, "totp secret for unknown user bill"},
+		{"bad base32", "alice: not-base32!\n", 0600, "user alice totp secret is not valid base32"},
+		{"short secret", "alice: GEZDGNBV\n", 0600, "user alice totp secret must be at least 80 bits"},
+		{"readable", testTOTPSecrets, 0644, "must not be accessible to group or others"},
+		{"not yaml", "- alice\n", 0600, "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SettingsLoad(writeTOTPSettings(t, tt.secrets, tt.mode))
+			t.Log(err)
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// usersFile is the layout of a file in the users directory, which
+// holds a user_principals list in the same form as the settings file
+type usersFile struct {
+	Users []*UserPrincipals `yaml:"user_principals"`
+}
+
+// loadUsersDir adds the users defined in the .yaml and .yml files in
+// the users directory, in file name order. A relative users directory
+// is relative to the directory of the settings file at settingsPath.
+// A user name may only be defined in one file.
+func (s *Settings) loadUsersDir(settingsPath string) error {
+
+	dir := s.UsersDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(settingsPath), dir)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read users_dir: %w", err)
+	}
+	s.sources = append(s.sources, dir)
+
+	defined := map[string]*UserPrincipals{}
+	for _, u := range s.Users {
+		if _, ok := defined[u.Name]; !ok {
+			defined[u.Name] = u
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || strings.HasPrefix(name, ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		filer, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var f usersFile
+		err = yaml.Unmarshal(filer, &f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		s.sources = append(s.sources, path)
+
+		for _, u := range f.Users {
+			if u == nil {
+				return fmt.Errorf("%s: empty user entry", path)
+			}
+			u.file = path
+			if d, ok := defined[u.Name]; ok && d.file != path {
+				return u.sourceError(fmt.Errorf("user %s already defined at %s", u.Name, d.Source()))
+			} else if !ok {
+				defined[u.Name] = u
+			}
+			s.Users = append(s.Users, u)
+		}
+	}
+	return nil
+}
+
+// Sources returns the settings file, users directory and users
+// directory files from which the settings were loaded
+func (s *Settings) Sources() []string {
+	return s.sources
+}
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestUsersDir(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_usersdir.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	names := []string{}
+	for _, u := range settings.Users {
+		names = append(names, u.Name)
+	}
+	if want := []string{"bob", "alice", "carol", "dave"}; !slices.Equal(names, want) {
+		t.Errorf("got users %v want %v", names, want)
+	}
+	dave := settings.Users[3]
+	if got, want := dave.Source(), filepath.Join("testdata", "users.d", "20-dba.yml")+":9"; got != want {
+		t.Errorf("got source %s want %s", got, want)
+	}
+	user, err := settings.UserByFingerprint(dave.Keys[0].Fingerprint)
+	if err != nil || user != dave {
+		t.Errorf("included user not found by fingerprint: %v", err)
+	}
+	if len(settings.Sources()) != 4 {
+		t.Errorf("unexpected sources %v", settings.Sources())
+	}
+}
+
+// writeUsersDir writes a settings file including a users directory
+// holding files, returning the settings file path
+func writeUsersDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	settings, err := os.ReadFile("testdata/settings_usersdir.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "settings.yaml")
+	if err := os.WriteFile(path, settings, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "users.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, "users.d", name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestUsersDirErrors(t *testing.T) {
+	const alice = `user_principals:
+    -
+        name: alice
+        sshpublickey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA92xmmsXU7kUfuVrMJKW799MxX4FO5DizhBtK8fStml alice@test.com"
+        principals:
+            - web
+`
+	const bobKey = `user_principals:
+    -
+        name: robert
+        sshpublickey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHbnCfkNiWUUMUcudbFVHU1pefuFfmz8gbtTMVA0hdWD bob@test.com"
+        principals:
+            - web
+`
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{"duplicate name across files", map[string]string{"a.yaml": alice, "b.yaml": alice}, "users.d/b.yaml:3: user alice already defined at "},
+		{"duplicate name of settings user", map[string]string{"a.yaml": `user_principals:
+    -
+        name: bob
+        sshpublickey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIA92xmmsXU7kUfuVrMJKW799MxX4FO5DizhBtK8fStml alice@test.com"
+        principals:
+            - web
+`}, "users.d/a.yaml:3: user bob already defined at "},
+		{"duplicate key across files", map[string]string{"a.yaml": bobKey}, "users.d/a.yaml:3: user robert key already exists at "},
+		{"invalid user", map[string]string{"a.yaml": alice, "b.yaml": `user_principals:
+    -
+        name: erin
+        sshpublickey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEmbgZ6TutoaNLk9URO45rAWIx0X06WGg5QFAa9Uy5hW erin@test.com"
+        principals:
+            - web
+        validity: 2000
+`}, "users.d/b.yaml:3: user erin validity must be <1440"},
+		{"invalid yaml", map[string]string{"a.yaml": "user_principals: [\n"}, "users.d/a.yaml: yaml:"},
+		{"invalid key", map[string]string{"a.yaml": alice, "b.yaml": `user_principals:
+    -
+        name: erin
+        sshpublickey: "ssh-ed25519 AAAA erin@test.com"
+        principals:
+            - web
+`}, "users.d/b.yaml: line 3: yaml error: user erin has an invalid public key"},
+		{"invalid user field", map[string]string{"a.yaml": `user_principals:
+    -
+        name: erin
+        principals: web
+`}, "users.d/a.yaml: line 3: Yaml parsing error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SettingsLoad(writeUsersDir(t, tt.files))
+			t.Logf("%v", err)
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUsersDirMissing(t *testing.T) {
+	dir := t.TempDir()
+	settings, err := os.ReadFile("testdata/settings_usersdir.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "settings.yaml")
+	if err := os.WriteFile(path, settings, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = SettingsLoad(path)
+	if !ErrorContains(err, "could not read users_dir") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
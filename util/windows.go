@@ -0,0 +1,217 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AccessWindow is a named period of the week during which certificates
+// may be issued, such as business hours. Days lists the days of the
+// week on which the window opens, all days if empty. Hours is a range
+// such as "09:00-18:00", all day if empty; a range ending at or before
+// its start, such as "22:00-06:00", runs past midnight. Times are in
+// Timezone, UTC if empty.
+type AccessWindow struct {
+	Timezone string   `yaml:"timezone"`
+	Days     []string `yaml:"days"`
+	Hours    string   `yaml:"hours"`
+	location *time.Location
+	days     map[time.Weekday]bool
+	start    int // minutes from midnight
+	end      int
+}
+
+// weekdays are the day names allowed in access window days
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parse the timezone, days and hours of the window
+func (w *AccessWindow) parse() error {
+
+	var err error
+	w.location, err = time.LoadLocation(w.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %s", w.Timezone)
+	}
+
+	w.days = map[time.Weekday]bool{}
+	for _, d := range w.Days {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("invalid day %s", d)
+		}
+		w.days[day] = true
+	}
+
+	w.start, w.end = 0, 24*60
+	if w.Hours == "" {
+		return nil
+	}
+	from, to, ok := strings.Cut(w.Hours, "-")
+	if !ok {
+		return fmt.Errorf("invalid hours %s", w.Hours)
+	}
+	if w.start, err = parseClock(from); err != nil {
+		return fmt.Errorf("invalid hours %s", w.Hours)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return fmt.Errorf("invalid hours %s", w.Hours)
+	}
+	if w.start == w.end {
+		return fmt.Errorf("invalid hours %s: window is empty", w.Hours)
+	}
+	return nil
+}
+
+// parseClock parses a time of day such as 09:30 or 24:00 to minutes
+// from midnight
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m); err != nil || n != 2 {
+		return 0, errors.New("invalid time")
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errors.New("invalid time")
+	}
+	return h*60 + m, nil
+}
+
+// OpenUntil reports if the window is open at t and, if so, the time at
+// which it closes
+func (w *AccessWindow) OpenUntil(t time.Time) (time.Time, bool) {
+
+	local := t.In(w.location)
+
+	// the window may have opened today or, if it runs past midnight,
+	// yesterday
+	for daysBack := 0; daysBack <= 1; daysBack++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()-daysBack, 0, 0, 0, 0, w.location)
+		if len(w.days) > 0 && !w.days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, w.start, 0, 0, w.location)
+		end := time.Date(day.Year(), day.Month(), day.Day(), 0, w.end, 0, 0, w.location)
+		if w.end <= w.start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if !local.Before(start) && local.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// String describes the window for users
+func (w *AccessWindow) String() string {
+	days := "every day"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ",")
+	}
+	hours := "all day"
+	if w.Hours != "" {
+		hours = w.Hours
+	}
+	return fmt.Sprintf("%s %s %s", days, hours, w.location)
+}
+
+// WindowError reports that a certificate was refused because none of
+// its access windows were open. The message is suitable for showing to
+// the user.
+type WindowError struct {
+	Windows []string
+	Details []string
+}
+
+func (e *WindowError) Error() string {
+	return fmt.Sprintf("certificates are only issued during %s (%s)",
+		strings.Join(e.Windows, " or "), strings.Join(e.Details, "; "))
+}
+
+// AccessUntil checks the access windows of spec at t, returning the
+// time at which the latest closing open window closes, or the zero
+// time if spec has no access windows. A *WindowError is returned if no
+// window is open.
+func (s *Settings) AccessUntil(spec *CertSpec, t time.Time) (time.Time, error) {
+	if len(spec.AccessWindows) == 0 {
+		return time.Time{}, nil
+	}
+	var until time.Time
+	details := []string{}
+	for _, name := range spec.AccessWindows {
+		w, ok := s.Windows[name]
+		if !ok {
+			return time.Time{}, fmt.Errorf("unknown access window %s", name)
+		}
+		details = append(details, w.String())
+		if end, open := w.OpenUntil(t); open && end.After(until) {
+			until = end
+		}
+	}
+	if until.IsZero() {
+		return until, &WindowError{Windows: spec.AccessWindows, Details: details}
+	}
+	return until, nil
+}
+
+// validateWindows checks and parses the access windows
+func (s *Settings) validateWindows() error {
+	for _, name := range slices.Sorted(maps.Keys(s.Windows)) {
+		w := s.Windows[name]
+		if name == "" {
+			return errors.New("access window provided with empty name")
+		}
+		if w == nil {
+			return fmt.Errorf("access window %s is empty", name)
+		}
+		if err := w.parse(); err != nil {
+			return fmt.Errorf("access window %s %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validateWindowNames checks the access windows named exist
+func (s *Settings) validateWindowNames(names []string) error {
+	for _, n := range names {
+		if _, ok := s.Windows[n]; !ok {
+			return fmt.Errorf("unknown access window %s", n)
+		}
+	}
+	return nil
+}
+
+// applyGroupWindows combines the access windows of the groups, so that
+// a certificate may be issued during the windows of any group. A group
+// with an empty access_windows list, such as an on call group, lifts
+// the restriction. Groups not setting access_windows have no effect.
+func (spec *CertSpec) applyGroupWindows(groups []*Group) {
+	var windows []string
+	for _, g := range groups {
+		if g.AccessWindows == nil {
+			continue
+		}
+		if len(g.AccessWindows) == 0 {
+			spec.override(CertOptions{AccessWindows: []string{}})
+			return
+		}
+		for _, w := range g.AccessWindows {
+			if !slices.Contains(windows, w) {
+				windows = append(windows, w)
+			}
+		}
+	}
+	if windows != nil {
+		spec.override(CertOptions{AccessWindows: windows})
+	}
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAccessWindowOpenUntil(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_windows.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("timezone data not available")
+	}
+	business, night := settings.Windows["business"], settings.Windows["night"]
+
+	tests := []struct {
+		name   string
+		window *AccessWindow
+		at     time.Time
+		until  time.Time // zero if closed
+	}{
+		{"weekday", business, time.Date(2026, 10, 14, 10, 0, 0, 0, london), time.Date(2026, 10, 14, 18, 0, 0, 0, london)},
+		{"opening", business, time.Date(2026, 10, 14, 9, 0, 0, 0, london), time.Date(2026, 10, 14, 18, 0, 0, 0, london)},
+		{"before opening", business, time.Date(2026, 10, 14, 8, 59, 0, 0, london), time.Time{}},
+		{"closing", business, time.Date(2026, 10, 14, 18, 0, 0, 0, london), time.Time{}},
+		{"weekend", business, time.Date(2026, 10, 17, 10, 0, 0, 0, london), time.Time{}},
+		{"other timezone", business, time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC), time.Date(2026, 10, 14, 18, 0, 0, 0, london)},
+		{"before midnight", night, time.Date(2026, 10, 14, 23, 0, 0, 0, time.UTC), time.Date(2026, 10, 15, 6, 0, 0, 0, time.UTC)},
+		{"after midnight", night, time.Date(2026, 10, 15, 3, 0, 0, 0, time.UTC), time.Date(2026, 10, 15, 6, 0, 0, 0, time.UTC)},
+		{"daytime", night, time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, open := tt.window.OpenUntil(tt.at)
+			if open != !tt.until.IsZero() || !until.Equal(tt.until) {
+				t.Errorf("got open %t until %s want %s", open, until, tt.until)
+			}
+		})
+	}
+}
+
+func TestAccessWindowSpecs(t *testing.T) {
+	settings, err := SettingsLoad("testdata/settings_windows.yaml")
+	if err != nil {
+		t.Fatalf("Could not parse yaml %v", err)
+	}
+	alice, bob, carol := settings.Users[0], settings.Users[1], settings.Users[2]
+
+	tests := []struct {
+		name    string
+		user    *UserPrincipals
+		profile string
+		windows []string
+	}{
+		{"group window", alice, "", []string{"business"}},
+		{"on call group lifts window", bob, "", []string{}},
+		{"user window", carol, "", []string{"night"}},
+		{"profile lifts window", carol, "anytime", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := settings.CertSpec(tt.user, tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(spec.AccessWindows, tt.windows) {
+				t.Errorf("got windows %v want %v", spec.AccessWindows, tt.windows)
+			}
+		})
+	}
+
+	// alice is refused at the weekend, bob is not
+	saturday := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	spec, err := settings.CertSpec(alice, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = settings.AccessUntil(spec, saturday)
+	var windowErr *WindowError
+	if !errors.As(err, &windowErr) {
+		t.Fatalf("expected window error, got %v", err)
+	}
+	if want := "certificates are only issued during business (mon,tue,wed,thu,fri 09:00-18:00 Europe/London)"; err.Error() != want {
+		t.Errorf("got error %q want %q", err, want)
+	}
+	spec, err = settings.CertSpec(bob, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until, err := settings.AccessUntil(spec, saturday); err != nil || !until.IsZero() {
+		t.Errorf("unrestricted user got %s %v", until, err)
+	}
+}
+
+func TestAccessWindowValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(s *Settings)
+		err    string
+	}{
+		{"timezone", func(s *Settings) { s.Windows["night"].Timezone = "Nowhere/Special" }, "access window night invalid timezone Nowhere/Special"},
+		{"day", func(s *Settings) { s.Windows["night"].Days = []string{"funday"} }, "access window night invalid day funday"},
+		{"hours", func(s *Settings) { s.Windows["night"].Hours = "9-5" }, "access window night invalid hours 9-5"},
+		{"late hours", func(s *Settings) { s.Windows["night"].Hours = "09:00-25:00" }, "access window night invalid hours 09:00-25:00"},
+		{"empty hours", func(s *Settings) { s.Windows["night"].Hours = "09:00-09:00" }, "access window night invalid hours 09:00-09:00: window is empty"},
+		{"group window", func(s *Settings) { s.Groups["oncall"].AccessWindows = []string{"lunch"} }, "group oncall unknown access window lunch"},
+		{"user window", func(s *Settings) { s.Users[2].AccessWindows = []string{"lunch"} }, "user carol unknown access window lunch"},
+		{"profile window", func(s *Settings) { s.Users[2].Profiles["anytime"].AccessWindows = []string{"lunch"} }, "user carol profile anytime unknown access window lunch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := SettingsLoad("testdata/settings_windows.yaml")
+			if err != nil {
+				t.Fatalf("Could not parse yaml %v", err)
+			}
+			tt.mangle(&settings)
+			err = settings.validate()
+			if !ErrorContains(err, tt.err) {
+				t.Errorf("got error %v want %s", err, tt.err)
+			}
+		})
+	}
+}